@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/artyom/stack-update/stackupdate"
+	"go.yaml.in/yaml/v3"
+)
+
+// batchEntry is a single stack update listed in a -batch file.
+type batchEntry struct {
+	Stack      string            `yaml:"stack"`
+	Template   string            `yaml:"template"` // file path, relative to the batch file, or url
+	Parameters map[string]string `yaml:"parameters"`
+	ParamsFile string            `yaml:"paramsFile"` // relative to the batch file
+	Region     string            `yaml:"region"`
+	Profile    string            `yaml:"profile"`
+}
+
+// readBatch reads a YAML (or JSON) list of batch entries from file name.
+func readBatch(name string) ([]batchEntry, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var entries []batchEntry
+	if err := yaml.Unmarshal(b, &entries); err != nil {
+		return nil, fmt.Errorf("parsing batch file %s: %w", name, err)
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("batch file %s has no entries", name)
+	}
+	dir := filepath.Dir(name)
+	for i, e := range entries {
+		if e.Template == "" {
+			return nil, fmt.Errorf("batch file %s: entry %d has no template", name, i+1)
+		}
+		if !isURL(e.Template) && !filepath.IsAbs(e.Template) {
+			entries[i].Template = filepath.Join(dir, e.Template)
+		}
+		if e.ParamsFile != "" && !filepath.IsAbs(e.ParamsFile) {
+			entries[i].ParamsFile = filepath.Join(dir, e.ParamsFile)
+		}
+	}
+	return entries, nil
+}
+
+// runBatch updates stacks listed in args.batch file one after another,
+// then prints a consolidated report.
+func runBatch(ctx context.Context, opts stackupdate.Options, args cliArgs) error {
+	if args.templateFile != "" || opts.StackName != "" {
+		return errors.New("-batch is mutually exclusive with -n flag and template argument")
+	}
+	if len(args.regions) != 0 || len(args.profiles) != 0 {
+		return errors.New("-batch is mutually exclusive with -regions and -profiles, set region and profile per entry instead")
+	}
+	entries, err := readBatch(args.batch)
+	if err != nil {
+		return err
+	}
+	byLabel := make(map[string]batchEntry, len(entries))
+	var labels []string
+	for _, e := range entries {
+		label := stackName(e.Stack, e.Template)
+		if e.Profile != "" {
+			label = e.Profile + "/" + label
+		}
+		if e.Region != "" {
+			label += "@" + e.Region
+		}
+		if _, ok := byLabel[label]; ok {
+			return fmt.Errorf("batch file %s lists %s more than once", args.batch, label)
+		}
+		byLabel[label] = e
+		labels = append(labels, label)
+	}
+	return fanOut(logger(opts), "stack", labels, args.continueOnError, args.maxConcurrent, func(label string, out io.Writer) error {
+		e := byLabel[label]
+		eopts := withOutput(opts, out)
+		eopts.StackName = e.Stack
+		eargs := args
+		eargs.templateFile = e.Template
+		if e.ParamsFile != "" {
+			eargs.paramsFile = e.ParamsFile
+		}
+		eargs.params = nil
+		for _, k := range slices.Sorted(maps.Keys(e.Parameters)) {
+			eargs.params = append(eargs.params, k+"="+e.Parameters[k])
+		}
+		if e.Region != "" {
+			eargs.region = e.Region
+		}
+		if e.Profile != "" {
+			eargs.profile = e.Profile
+		}
+		return run(ctx, eopts, eargs)
+	})
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/artyom/stack-update/stackupdate"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+)
+
+// This file holds read-only commands that inspect a stack without updating it.
+
+func listChangeSets(ctx context.Context, name string, args cliArgs) error {
+	if name == "" && args.templateFile == "" {
+		return errors.New("want either -n flag, or template file as the first argument")
+	}
+	cfg, err := loadConfig(ctx, args)
+	if err != nil {
+		return err
+	}
+	return stackupdate.ListChangeSets(ctx, cloudformation.NewFromConfig(cfg), stackName(name, args.templateFile), os.Stdout)
+}
+
+func describeChangeSet(ctx context.Context, name, changeSet string, args cliArgs, format string) error {
+	if name == "" && args.templateFile != "" {
+		name = stackName(name, args.templateFile)
+	}
+	if name == "" && !strings.HasPrefix(changeSet, "arn:") {
+		return errors.New("want either change set ARN, or stack name set with -n flag or derived from template file name")
+	}
+	switch format {
+	case "table", "diff", "json":
+	default:
+		return fmt.Errorf("unsupported -format %q for describing change set, want table, diff, or json", format)
+	}
+	cfg, err := loadConfig(ctx, args)
+	if err != nil {
+		return err
+	}
+	return stackupdate.DescribeChangeSet(ctx, cloudformation.NewFromConfig(cfg), name, changeSet, os.Stdout, format)
+}
+
+func compareChangeSets(ctx context.Context, name, changeSets string, args cliArgs, format string) error {
+	first, second, ok := strings.Cut(changeSets, ",")
+	if !ok || first == "" || second == "" {
+		return errors.New("want two comma-separated change set names or ARNs")
+	}
+	if name == "" && args.templateFile != "" {
+		name = stackName(name, args.templateFile)
+	}
+	if name == "" && (!strings.HasPrefix(first, "arn:") || !strings.HasPrefix(second, "arn:")) {
+		return errors.New("want either change set ARNs, or stack name set with -n flag or derived from template file name")
+	}
+	var asJSON bool
+	switch format {
+	case "table":
+	case "json":
+		asJSON = true
+	default:
+		return fmt.Errorf("unsupported -format %q for comparing change sets, want table or json", format)
+	}
+	cfg, err := loadConfig(ctx, args)
+	if err != nil {
+		return err
+	}
+	return stackupdate.CompareChangeSets(ctx, cloudformation.NewFromConfig(cfg), name, first, second, os.Stdout, asJSON)
+}
+
+func listStackResources(ctx context.Context, name string, args cliArgs, format string) error {
+	if name == "" && args.templateFile == "" {
+		return errors.New("want either -n flag, or template file as the first argument")
+	}
+	var asJSON bool
+	switch format {
+	case "table":
+	case "json":
+		asJSON = true
+	default:
+		return fmt.Errorf("unsupported -format %q for listing stack resources, want table or json", format)
+	}
+	cfg, err := loadConfig(ctx, args)
+	if err != nil {
+		return err
+	}
+	return stackupdate.ListStackResources(ctx, cloudformation.NewFromConfig(cfg), stackName(name, args.templateFile), os.Stdout, asJSON)
+}
+
+func showHistory(name, dir string, args cliArgs, format string) error {
+	if name == "" && args.templateFile == "" {
+		return errors.New("want either -n flag, or template file as the first argument")
+	}
+	if dir == "" {
+		return errors.New("-history requires -history-dir")
+	}
+	var asJSON bool
+	switch format {
+	case "table":
+	case "json":
+		asJSON = true
+	default:
+		return fmt.Errorf("unsupported -format %q for stack history, want table or json", format)
+	}
+	return stackupdate.History(dir, stackName(name, args.templateFile), os.Stdout, asJSON)
+}
+
+// attach waits for an update of args.attach stack, or change set, that is
+// already in progress, e.g. started by an interrupted run.
+func attach(ctx context.Context, opts stackupdate.Options, args cliArgs) error {
+	if args.templateFile != "" || opts.StackName != "" {
+		return errors.New("-attach is mutually exclusive with -n flag and template argument")
+	}
+	cfg, err := loadConfig(ctx, args)
+	if err != nil {
+		return err
+	}
+	opts.CloudFormation = cloudformation.NewFromConfig(cfg)
+	opts.ConsoleDomain = args.consoleDomain
+	if c, ok := cfg.Credentials.(*aws.CredentialsCache); ok {
+		opts.RefreshCredentials = c.Invalidate
+	}
+	return stackupdate.Attach(ctx, opts, args.attach)
+}
+
+// diffParameters prints parameters loaded by run that differ from current
+// stack parameters.
+func diffParameters(ctx context.Context, cfg aws.Config, opts stackupdate.Options) error {
+	var asJSON bool
+	switch opts.Format {
+	case "table":
+	case "json":
+		asJSON = true
+	default:
+		return fmt.Errorf("unsupported -format %q for parameters diff, want table or json", opts.Format)
+	}
+	svc := cloudformation.NewFromConfig(cfg)
+	secretParams, err := resolveParameters(ctx, svc, secretsmanager.NewFromConfig(cfg), opts.StackName, opts.Parameters)
+	if err != nil {
+		return err
+	}
+	opts.Redact = redactSecrets(opts.Redact, secretParams)
+	opts.CloudFormation = svc
+	return stackupdate.DiffParameters(ctx, opts, asJSON)
+}
+
+// showParameters prints current stack parameters as JSON in AWS CLI format,
+// suitable for -params-file. Values of NoEcho parameters are not returned by
+// CloudFormation, so such parameters are printed with UsePreviousValue set;
+// so are parameters with names matching redactRe.
+func showParameters(ctx context.Context, name string, redactRe *regexp.Regexp, args cliArgs) error {
+	if name == "" && args.templateFile == "" {
+		return errors.New("want either -n flag, or template file as the first argument")
+	}
+	cfg, err := loadConfig(ctx, args)
+	if err != nil {
+		return err
+	}
+	stack, err := stackupdate.DescribeStack(ctx, cloudformation.NewFromConfig(cfg), stackName(name, args.templateFile))
+	if err != nil {
+		return err
+	}
+	type parameter struct {
+		ParameterKey     string
+		ParameterValue   string `json:",omitempty"`
+		UsePreviousValue bool   `json:",omitempty"`
+	}
+	out := []parameter{}
+	for _, p := range stack.Parameters {
+		v := unptr(p.ParameterValue)
+		if v == noEchoValue || redactRe != nil && redactRe.MatchString(unptr(p.ParameterKey)) {
+			out = append(out, parameter{ParameterKey: unptr(p.ParameterKey), UsePreviousValue: true})
+			continue
+		}
+		out = append(out, parameter{ParameterKey: unptr(p.ParameterKey), ParameterValue: v})
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
+
+// noEchoValue is what CloudFormation returns in place of NoEcho parameter
+// values.
+const noEchoValue = "****"
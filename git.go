@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// gitInfo returns commit id and branch name of a git repository in the
+// current directory. It returns empty strings if git is not available or the
+// current directory is not within a repository. Branch is empty on detached
+// HEAD. If ref is set, it returns its commit id instead, and ref itself in
+// place of the branch.
+func gitInfo(ctx context.Context, ref string) (commit, branch string) {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	rev := "HEAD"
+	if ref != "" {
+		rev = ref + "^{commit}"
+	}
+	out, err := exec.CommandContext(ctx, "git", "rev-parse", "--short=12", rev).Output()
+	if err != nil {
+		return "", ""
+	}
+	commit = string(bytes.TrimSpace(out))
+	if ref != "" {
+		return commit, ref
+	}
+	if out, err = exec.CommandContext(ctx, "git", "rev-parse", "--abbrev-ref", "HEAD").Output(); err == nil {
+		if b := string(bytes.TrimSpace(out)); b != "HEAD" {
+			branch = b
+		}
+	}
+	return commit, branch
+}
+
+// gitDir returns the .git directory of a repository in the current
+// directory.
+func gitDir(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "git", "rev-parse", "--absolute-git-dir").Output()
+	if err != nil {
+		return "", fmt.Errorf("finding git directory: %w", err)
+	}
+	return string(bytes.TrimSpace(out)), nil
+}
+
+// gitShow returns contents of file name at git ref of the repository in the
+// current directory. Relative names are relative to the current directory.
+func gitShow(ctx context.Context, ref, name string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	if err := exec.CommandContext(ctx, "git", "rev-parse", "--verify", "--quiet", ref+"^{commit}").Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("resolving git ref %q: %w", ref, ctx.Err())
+		}
+		return nil, fmt.Errorf("git ref %q not found in repository of the current directory", ref)
+	}
+	if filepath.IsAbs(name) {
+		wd, err := os.Getwd()
+		if err != nil {
+			return nil, err
+		}
+		if name, err = filepath.Rel(wd, name); err != nil {
+			return nil, err
+		}
+	}
+	// in ref:path syntax, paths starting with ./ or ../ are relative to
+	// the current directory, others to the repository root
+	name = filepath.ToSlash(name)
+	if !strings.HasPrefix(name, "../") {
+		name = "./" + name
+	}
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "git", "show", ref+":"+name)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := bytes.TrimSpace(stderr.Bytes()); len(msg) != 0 {
+			return nil, fmt.Errorf("reading %s at git ref %q: %w: %s", name, ref, err, msg)
+		}
+		return nil, fmt.Errorf("reading %s at git ref %q: %w", name, ref, err)
+	}
+	return out, nil
+}
+
+// commitNoteFile is a file in .git directory that -write-commit-note appends
+// to, for git hooks to pick up, e.g. to add it to a commit message.
+const commitNoteFile = "STACK_UPDATE_NOTE"
+
+// writeCommitNote appends a note about the stack update with the change set
+// table to commitNoteFile in the .git directory of the current repository.
+func writeCommitNote(ctx context.Context, stackName string, changes []byte) error {
+	dir, err := gitDir(ctx)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, commitNoteFile), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	changes = ansiEscape.ReplaceAll(changes, nil)
+	if _, err := fmt.Fprintf(f, "Updated stack %s at %s:\n%s\n", stackName, time.Now().UTC().Format(time.RFC3339), bytes.TrimSpace(changes)); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+var ansiEscape = regexp.MustCompile("\033\\[[0-9;]*m")
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"time"
+
+	"github.com/artyom/stack-update/stackupdate"
+)
+
+// setHooks configures opts to run args.preExecCmd and args.postExecCmd shell
+// commands around change set execution.
+func setHooks(opts *stackupdate.Options, args cliArgs, region string) {
+	run := func(ctx context.Context, name, command string, env []string) error {
+		ctx, cancel := context.WithTimeout(ctx, args.hookTimeout)
+		defer cancel()
+		cmd := shellCommand(ctx, command)
+		cmd.Env = append(os.Environ(), env...)
+		w := logger(*opts).Writer()
+		cmd.Stdout, cmd.Stderr = w, w
+		begin := time.Now()
+		if err := cmd.Run(); err != nil {
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return fmt.Errorf("%s timed out after %v", name, args.hookTimeout)
+			}
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if opts.Verbose {
+			logger(*opts).Printf("%s finished in %v", name, time.Since(begin).Round(time.Millisecond))
+		}
+		return nil
+	}
+	hookEnv := func(stackID, changeSetID string) []string {
+		return []string{
+			"STACK_UPDATE_STACK_NAME=" + opts.StackName,
+			"STACK_UPDATE_STACK_ID=" + stackID,
+			"STACK_UPDATE_REGION=" + region,
+			"STACK_UPDATE_CHANGE_SET_ID=" + changeSetID,
+		}
+	}
+	if args.preExecCmd != "" {
+		opts.BeforeExecute = func(ctx context.Context, stackID, changeSetID string) error {
+			return run(ctx, "-pre-exec-cmd", args.preExecCmd, hookEnv(stackID, changeSetID))
+		}
+	}
+	if args.postExecCmd != "" {
+		opts.AfterExecute = func(ctx context.Context, stackID, changeSetID string, err error) {
+			env := append(hookEnv(stackID, changeSetID), "STACK_UPDATE_RESULT=success")
+			if err != nil {
+				env = append(hookEnv(stackID, changeSetID), "STACK_UPDATE_RESULT=failure", "STACK_UPDATE_ERROR="+err.Error())
+			}
+			if err := run(ctx, "-post-exec-cmd", args.postExecCmd, env); err != nil {
+				logger(*opts).Printf("WARNING: %v", err)
+			}
+		}
+	}
+}
+
+// shellCommand returns a command running s with the system shell.
+func shellCommand(ctx context.Context, s string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.CommandContext(ctx, "cmd", "/C", s)
+	}
+	return exec.CommandContext(ctx, "sh", "-c", s)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	ddbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// lockInfo describes who holds a stack update lock.
+type lockInfo struct {
+	Holder string    `json:"holder"`
+	Since  time.Time `json:"since"`
+}
+
+func (l lockInfo) String() string {
+	return fmt.Sprintf("%s since %s", l.Holder, l.Since.Local().Format(time.DateTime))
+}
+
+// acquireLock takes a lock preventing concurrent updates of the stack in the
+// account and cfg.Region, so that the same stack name in other regions is
+// locked separately. The spec is either "file", to use a local lock file, or
+// "dynamodb:TableName", to use a DynamoDB table with a string partition key
+// named LockID. On success it returns a function releasing the lock, which
+// reports failures to lg.
+func acquireLock(ctx context.Context, cfg aws.Config, lg *log.Logger, spec, account, stackName, caller string) (release func(), err error) {
+	id := account + "/" + cfg.Region + "/" + stackName
+	host, _ := os.Hostname()
+	info := lockInfo{
+		Holder: fmt.Sprintf("%s on %s, pid %d", caller, host, os.Getpid()),
+		Since:  time.Now().UTC(),
+	}
+	switch {
+	case spec == "file":
+		return acquireFileLock(id, info)
+	case strings.HasPrefix(spec, "dynamodb:"):
+		table := strings.TrimPrefix(spec, "dynamodb:")
+		if table == "" {
+			return nil, errors.New("want dynamodb:TableName lock")
+		}
+		return acquireDynamoDBLock(ctx, dynamodb.NewFromConfig(cfg), lg, table, id, info)
+	}
+	return nil, fmt.Errorf("unsupported lock %q, want file or dynamodb:TableName", spec)
+}
+
+func acquireFileLock(id string, info lockInfo) (func(), error) {
+	name := filepath.Join(os.TempDir(), "stack-update-"+strings.ReplaceAll(id, "/", "-")+".lock")
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if errors.Is(err, os.ErrExist) {
+		var held lockInfo
+		if b, err := os.ReadFile(name); err == nil && json.Unmarshal(b, &held) == nil {
+			return nil, fmt.Errorf("stack update is locked by %v; if that's stale, remove %s", held, name)
+		}
+		return nil, fmt.Errorf("stack update is locked by %s", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := json.NewEncoder(f).Encode(info); err != nil {
+		os.Remove(name)
+		return nil, err
+	}
+	return func() { os.Remove(name) }, nil
+}
+
+func acquireDynamoDBLock(ctx context.Context, svc *dynamodb.Client, lg *log.Logger, table, id string, info lockInfo) (func(), error) {
+	key := map[string]ddbtypes.AttributeValue{"LockID": &ddbtypes.AttributeValueMemberS{Value: id}}
+	_, err := svc.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: &table,
+		Item: map[string]ddbtypes.AttributeValue{
+			"LockID": &ddbtypes.AttributeValueMemberS{Value: id},
+			"Holder": &ddbtypes.AttributeValueMemberS{Value: info.Holder},
+			"Since":  &ddbtypes.AttributeValueMemberS{Value: info.Since.Format(time.RFC3339)},
+		},
+		ConditionExpression: new("attribute_not_exists(LockID)"),
+	})
+	if _, ok := errors.AsType[*ddbtypes.ConditionalCheckFailedException](err); ok {
+		out, err := svc.GetItem(ctx, &dynamodb.GetItemInput{TableName: &table, Key: key, ConsistentRead: new(true)})
+		if err != nil || out.Item == nil {
+			return nil, fmt.Errorf("stack update is locked in %s table", table)
+		}
+		var held lockInfo
+		if v, ok := out.Item["Holder"].(*ddbtypes.AttributeValueMemberS); ok {
+			held.Holder = v.Value
+		}
+		if v, ok := out.Item["Since"].(*ddbtypes.AttributeValueMemberS); ok {
+			held.Since, _ = time.Parse(time.RFC3339, v.Value)
+		}
+		return nil, fmt.Errorf("stack update is locked by %v; if that's stale, delete %q item from %s table", held, id, table)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("DynamoDB PutItem: %w", err)
+	}
+	return func() {
+		// don't use outer scope ctx because it may be already canceled
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if _, err := svc.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+			TableName:                 &table,
+			Key:                       key,
+			ConditionExpression:       new("Holder = :holder"),
+			ExpressionAttributeValues: map[string]ddbtypes.AttributeValue{":holder": &ddbtypes.AttributeValueMemberS{Value: info.Holder}},
+		}); err != nil {
+			lg.Printf("releasing lock: %v", err)
+		}
+	}, nil
+}
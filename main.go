@@ -1,18 +1,14 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
 	"context"
-	"crypto/rand"
-	"crypto/sha256"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"maps"
-	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
@@ -22,337 +18,761 @@ import (
 	"runtime"
 	"slices"
 	"strings"
-	"text/tabwriter"
+	"sync"
 	"time"
 
+	"github.com/artyom/stack-update/stackupdate"
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/cloudformation"
 	"github.com/aws/aws-sdk-go-v2/service/cloudformation/types"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"golang.org/x/term"
 )
 
 func main() {
 	log.SetFlags(0)
-	var name string
-	flag.StringVar(&name, "n", name, "stack `name`; if not set, derived from template name")
+	var opts stackupdate.Options
+	var args cliArgs
+	onNoChanges := "success"
+	var quietOnNoChanges bool
+	var detectChanges bool
+	var allowDestructive bool
+	flag.StringVar(&opts.StackName, "n", opts.StackName, "stack `name`; if not set, derived from template name")
+	flag.BoolVar(&args.strictName, "strict-name", false, "require stack name to be set with -n, instead of deriving it from template file name")
+	flag.BoolVar(&opts.Events, "events", opts.Events, "print stack events while waiting for update to complete")
+	flag.BoolVar(&opts.EventsOnFailure, "events-on-failure", false, "collect stack events while waiting for update to complete, print them only if it fails")
+	flag.BoolVar(&opts.Progress, "progress", false, "log how many resources completed their update while waiting for it")
+	flag.IntVar(&opts.TailLines, "tail-lines", opts.TailLines, "with -events, print at most `N` latest events per poll; 0 means unlimited")
+	flag.StringVar(&args.profile, "profile", args.profile, "use this shared config `profile`")
+	flag.StringVar(&args.credentialsFile, "credentials-file", args.credentialsFile, "load shared credentials from this `file` instead of the default location")
+	flag.BoolVar(&opts.NoExecuteIfEmpty, "no-execute-if-empty", opts.NoExecuteIfEmpty, "exit without prompting if change set has no resource changes")
+	flag.BoolVar(&quietOnNoChanges, "quiet-on-no-changes", false, "print nothing if there's nothing to update; output is held back until changes are shown")
+	flag.StringVar(&onNoChanges, "on-no-changes", onNoChanges, "exit status when there's nothing to update: `success` (0) or fail (3)")
+	flag.StringVar(&args.requireAccount, "require-account", args.requireAccount, "abort unless credentials belong to this AWS account `id`")
+	var templateDelivery string
+	flag.StringVar(&templateDelivery, "template-delivery", "", "how to pass template to CloudFormation: `mode` auto (inline if it's up to 51,200 bytes, upload to S3 otherwise), inline (fail if it's bigger), or s3 (always upload) (default auto)")
+	flag.BoolVar(&opts.NoUpload, "no-upload", opts.NoUpload, "fail instead of uploading templates over 51,200 bytes to S3; same as -template-delivery inline")
+	flag.Func("since", "with -events, print events newer than this `time` (RFC3339, or duration before now)", func(s string) error {
+		if d, err := time.ParseDuration(s); err == nil {
+			opts.EventsSince = time.Now().Add(-d)
+			return nil
+		}
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return errors.New("want RFC3339 time or duration")
+		}
+		opts.EventsSince = t
+		return nil
+	})
+	flag.StringVar(&args.paramsFile, "params-file", args.paramsFile, "load stack parameters from this JSON `file`; key=value arguments take precedence")
+	flag.StringVar(&args.paramsJSON, "params-json", args.paramsJSON, "stack parameters as inline `JSON`, in the same format as -params-file; key=value arguments take precedence")
+	flag.BoolVar(&args.sops, "sops", args.sops, "decrypt SOPS-encrypted -params-file and -env files by running sops binary")
+	flag.StringVar(&args.env, "env", args.env, "load parameters for this `environment` from params.ENV.json or params/ENV.json next to the template; other parameter sources take precedence")
+	flag.StringVar(&args.envFile, "env-file", args.envFile, "load parameters from this .env `file` of KEY=VALUE lines, ignoring keys that are not template parameters; other parameter sources take precedence")
+	flag.DurationVar(&opts.WaitReady, "wait-ready", opts.WaitReady, "if stack has an operation in progress, wait up to this `long` for it to finish")
+	opts.Redact = regexp.MustCompile(stackupdate.DefaultRedactPattern)
+	flag.Func("redact-pattern", "hide values of parameters with names matching this `regexp` in audit records, summaries, errors, and -parameters-show output; empty disables (default "+stackupdate.DefaultRedactPattern+")", func(s string) error {
+		if s == "" {
+			opts.Redact = nil
+			return nil
+		}
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return err
+		}
+		opts.Redact = re
+		return nil
+	})
+	flag.StringVar(&opts.HistoryDir, "history-dir", opts.HistoryDir, "keep a local history of executed change sets, a JSON file per stack, in this `directory`")
+	flag.StringVar(&args.attach, "attach", args.attach, "wait for an update in progress of the stack with this `name or change set ARN` to complete, printing events as with -events, and exit")
+	flag.BoolVar(&args.history, "history", args.history, "print change sets executed on the stack as recorded in -history-dir, latest first, and exit; -format json prints JSON")
+	flag.StringVar(&opts.AuditOut, "audit-out", opts.AuditOut, "write JSON record of executed change set to this `file` or s3://bucket/key url")
+	flag.BoolVar(&opts.DryRun, "dry-run", opts.DryRun, "only show changes, don't execute them")
+	flag.BoolVar(&args.watch, "watch", args.watch, "like -dry-run, but show changes again each time template file is modified, until interrupted")
+	flag.BoolVar(&detectChanges, "detect-changes", detectChanges, "like -dry-run, but exit with 2 if there are changes, and with 0 if there are none; errors exit with 1, or 4-8 for specific failures (see README)")
+	tags := make(tagFlag)
+	flag.Var(tags, "t", "stack tag as `key=value`, can be repeated; overrides tags from -tags-file")
+	flag.StringVar(&args.tagsFile, "tags-file", args.tagsFile, "load stack tags from this JSON or YAML `file`; these override existing stack tags")
+	flag.BoolVar(&opts.ForceUpload, "force-upload", opts.ForceUpload, "always upload template to S3, even if it's small enough to be provided inline; same as -template-delivery s3")
+	flag.StringVar(&opts.TemplateKeyPrefix, "template-key-prefix", opts.TemplateKeyPrefix, "`prefix` of S3 keys for uploaded templates")
+	flag.Func("template-acl", "canned `ACL` to set on uploaded templates, e.g. bucket-owner-full-control for a bucket in another account", func(s string) error {
+		if acl := s3types.ObjectCannedACL(s); !slices.Contains(acl.Values(), acl) {
+			return fmt.Errorf("unsupported canned ACL %q", s)
+		}
+		opts.TemplateACL = s
+		return nil
+	})
+	flag.BoolVar(&opts.TemplateKeyDate, "template-key-date", opts.TemplateKeyDate, "include upload date in S3 keys for uploaded templates")
+	flag.StringVar(&opts.TemplateFormat, "template-format", opts.TemplateFormat, "template `format`, json or yaml; if not set, derived from template file name or content")
+	flag.BoolVar(&args.listChangeSets, "list-change-sets", args.listChangeSets, "list existing stack change sets and exit")
+	flag.Var(&args.substitutions, "sub", "replace literal `OLD=NEW` text in template before using it, can be repeated to apply in order")
+	flag.BoolVar(&opts.Verbose, "v", opts.Verbose, "verbose output")
+	flag.BoolVar(&opts.Yes, "y", opts.Yes, "execute change set without asking for confirmation")
+	flag.BoolVar(&opts.YesOnEOF, "yes-on-eof", opts.YesOnEOF, "execute change set if standard input is closed without an answer to confirmation prompt, instead of aborting; allows non-terminal standard input")
+	flag.BoolVar(&args.showParameters, "parameters-show", args.showParameters, "print current stack parameters as JSON, suitable for -params-file, and exit")
+	flag.BoolVar(&args.diffParameters, "parameters-diff-only", args.diffParameters, "print parameters whose values given by flags and files differ from current stack values, without creating change set, and exit; -format json prints JSON")
+	flag.BoolVar(&args.checkPermissions, "check-permissions", args.checkPermissions, "before update, check that IAM policies of the caller allow actions it needs, using iam:SimulatePrincipalPolicy")
+	flag.StringVar(&args.lock, "lock", args.lock, "prevent concurrent updates of the stack (per account and region) with a lock: `file` for a local lock file, or dynamodb:TableName for a DynamoDB table with LockID string partition key")
+	flag.StringVar(&args.describeChangeSet, "describe-change-set", args.describeChangeSet, "show status and changes of existing change set with this `name or ARN`, and exit; respects -format")
+	flag.StringVar(&args.compareChangeSets, "compare-change-sets", args.compareChangeSets, "print resource changes found in only one of two comma-separated change sets (`names or ARNs`), and exit; -format json prints JSON")
+	flag.BoolVar(&args.stackResources, "describe-stack-resources", args.stackResources, "print current stack resources with their physical ids and statuses, and exit; -format json prints JSON")
+	flag.Func("capabilities", "comma-separated `list` of capabilities to acknowledge, e.g. CAPABILITY_IAM,CAPABILITY_AUTO_EXPAND", func(s string) error {
+		for v := range strings.SplitSeq(s, ",") {
+			c := types.Capability(strings.TrimSpace(v))
+			if !slices.Contains(c.Values(), c) {
+				return fmt.Errorf("unsupported capability %q", c)
+			}
+			opts.Capabilities = append(opts.Capabilities, c)
+		}
+		return nil
+	})
+	opts.AutoCapabilities = true
+	flag.BoolVar(&opts.AutoCapabilities, "auto-capabilities", opts.AutoCapabilities, "acknowledge capabilities that template likely needs, or CloudFormation reports as required")
+	flag.StringVar(&args.endpointURL, "endpoint-url", args.endpointURL, "send AWS API requests to this `url`, e.g. of LocalStack, instead of the default endpoints")
+	flag.BoolVar(&opts.ValidateParameters, "validate-params", opts.ValidateParameters, "check parameter values against types and constraints declared in template before creating change set")
+	flag.DurationVar(&args.timeout, "timeout", args.timeout, "abort if the whole run takes longer than this `duration`")
+	opts.CreateTimeout = 30 * time.Minute
+	flag.DurationVar(&opts.CreateTimeout, "create-timeout", opts.CreateTimeout, "abort if change set is not created within this `duration`; 0 means no limit")
+	flag.IntVar(&opts.CreateRetries, "create-retries", 2, "how many times to retry creating change set if stack has an operation in progress")
+	flag.StringVar(&args.preExecCmd, "pre-exec-cmd", "", "run this shell `command` right before executing change set, aborting the update if it fails; "+
+		"STACK_UPDATE_STACK_NAME, STACK_UPDATE_STACK_ID, STACK_UPDATE_REGION, and STACK_UPDATE_CHANGE_SET_ID environment variables are set for it")
+	flag.StringVar(&args.postExecCmd, "post-exec-cmd", "", "run this shell `command` after change set execution ends, even if the update failed; "+
+		"it gets the same environment as -pre-exec-cmd, plus STACK_UPDATE_RESULT set to success or failure, and STACK_UPDATE_ERROR on failure")
+	flag.DurationVar(&args.hookTimeout, "hook-timeout", 5*time.Minute, "limit how `long` each of -pre-exec-cmd and -post-exec-cmd commands can run")
+	flag.DurationVar(&opts.ExecuteDelay, "execute-delay", 0, "wait this `long` after confirmation, showing a countdown, before executing change set, so it can still be aborted with Ctrl+C")
+	flag.DurationVar(&opts.PromptTimeout, "prompt-timeout", 0, "abort if confirmation prompt is not answered within this `duration`; 0 means wait forever")
+	flag.DurationVar(&opts.CleanupTimeout, "cleanup-timeout", 10*time.Second, "how long to wait for change set to be deleted when it's not executed")
+	flag.DurationVar(&opts.ExecuteTimeout, "execute-timeout", opts.ExecuteTimeout, "abort if update does not complete within this `duration`; 0 means no limit")
+	flag.BoolVar(&opts.RollbackOnTimeout, "rollback-on-timeout", opts.RollbackOnTimeout, "on -timeout or -execute-timeout, cancel in-progress stack update, which triggers its rollback")
+	flag.Func("bucket-tag", "upload templates to the first bucket tagged with this `key=value`, instead of the cf-templates-* one", func(s string) error {
+		k, v, ok := strings.Cut(s, "=")
+		if !ok || k == "" {
+			return errors.New("want key=value")
+		}
+		opts.TemplateBucketTagKey, opts.TemplateBucketTagValue = k, v
+		return nil
+	})
+	flag.StringVar(&args.templateConfig, "template-config", args.templateConfig, "load parameters, tags, and stack policy from this CodePipeline template configuration `file`; other flags take precedence")
+	flag.BoolVar(&opts.Lint, "lint", opts.Lint, "warn about template issues, like use of deprecated resource types, or parameter defaults violating their constraints")
+	flag.StringVar(&opts.Description, "desc", stackupdate.DefaultDescription, "change set `description`, e.g. a ticket reference or commit id")
+	flag.StringVar(&args.gitRef, "git-ref", args.gitRef, "read template file as of this git `ref` (commit, branch, or tag) instead of the working tree")
+	flag.BoolVar(&args.noGitInfo, "no-git-info", false, "do not add git commit id and branch of the current directory to change set description")
+	flag.StringVar(&opts.ParameterStrategy, "param-strategy", "merge", "how to handle stack parameters not set explicitly: "+
+		"merge (keep previous values), replace (use template defaults, fail if there are none), "+
+		"or reset (use template defaults where they exist, keep previous values otherwise)")
+	flag.StringVar(&opts.CSVOut, "csv-out", "", "save resource changes as CSV to this `file` once change set is ready, for spreadsheet-based review")
+	flag.StringVar(&opts.OutputTemplate, "output-template", "", "save processed template (with transforms like SAM expanded) to this `file` once change set is ready")
+	flag.Func("template-stage", "with -output-template, save template of this `stage`: Processed (default, with transforms expanded) or Original (as submitted)", func(s string) error {
+		for _, v := range types.TemplateStage("").Values() {
+			if strings.EqualFold(s, string(v)) {
+				opts.OutputTemplateStage = v
+				return nil
+			}
+		}
+		return errors.New("want Original or Processed")
+	})
+	flag.Func("regions", "comma-separated `list` of regions to update the stack in, one after another", func(s string) error {
+		for r := range strings.SplitSeq(s, ",") {
+			if r = strings.TrimSpace(r); r != "" {
+				args.regions = append(args.regions, r)
+			}
+		}
+		return nil
+	})
+	flag.StringVar(&opts.GroupBy, "group-by", "", "set to \"type\" to show changes grouped by resource type")
+	flag.BoolVar(&opts.PromptParameters, "prompt-params", false, "ask for values of template parameters that have no default and no value set otherwise; if standard input is not a terminal, or with -y, fail listing them instead")
+	flag.Func("profiles", "comma-separated `list` of profiles to update the stack in the accounts of, one after another", func(s string) error {
+		for p := range strings.SplitSeq(s, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				args.profiles = append(args.profiles, p)
+			}
+		}
+		return nil
+	})
+	flag.BoolVar(&args.continueOnError, "continue-on-error", false, "with -regions, -profiles, or -batch, continue with the rest after a failure")
+	flag.StringVar(&opts.JUnitOut, "junit-out", "", "save JUnit XML report with a test case per resource change to this `file`, for CI test reporting")
+	flag.StringVar(&opts.SummaryOut, "summary-out", "", "save JSON summary of the run to this `file`, even on dry run or failure")
+	flag.BoolVar(&opts.AllowManaged, "allow-managed", false, "allow updating stacks nested in other stacks, or managed by StackSets")
+	flag.BoolVar(&opts.NoColor, "no-color", os.Getenv("NO_COLOR") != "", "don't use colors or bold text in output; set by default if NO_COLOR environment variable is set")
+	flag.StringVar(&opts.Format, "format", "table", "output `format`: table; diff for one line per change marked with + add, ~ modify, - remove, -/+ replace "+
+		"(updates and -describe-change-set); json (-describe-change-set, -compare-change-sets, -describe-stack-resources, -history, -parameters-diff-only)")
+	flag.BoolVar(&opts.CreateBucket, "create-bucket", false, "create cf-templates-*-region bucket to upload templates to, if there is none")
+	flag.BoolVar(&args.regionFromTemplate, "region-from-template", false, "use region from Metadata.StackUpdate.Region of the template, unless AWS_REGION or AWS_DEFAULT_REGION is set")
+	flag.BoolVar(&opts.FailOnIAMChanges, "fail-on-iam-changes", false, "show changes, then fail if any of them affect IAM resources or policies")
+	flag.BoolVar(&opts.FailOnDestructive, "fail-on-destructive", false, "show changes, then fail if any of them remove or replace resources")
+	flag.BoolVar(&allowDestructive, "allow-destructive", false, "override -fail-on-destructive, allowing changes that remove or replace resources")
+	flag.StringVar(&args.batch, "batch", "", "update stacks listed in this YAML `file` one after another, see README")
+	flag.StringVar(&args.consoleDomain, "console-domain", "", "AWS console `domain` for links, derived from stack ARN partition by default")
+	flag.DurationVar(&args.templateMaxAge, "template-max-age", 0, "warn if template downloaded by url was last modified longer than this `duration` ago")
+	flag.BoolVar(&args.writeCommitNote, "write-commit-note", false, "after update, append its changes to .git/"+commitNoteFile+" for git hooks to pick up")
+	flag.IntVar(&args.maxConcurrent, "max-concurrent-stacks", 1, "with -regions, -profiles, or -batch, update up to this `many` stacks in parallel; requires -y or -dry-run if more than 1")
+	flag.Func("include-type", "show only changes of resources of this `type` or glob pattern (can be repeated); others are still applied", func(s string) error {
+		opts.Filter.IncludeTypes = append(opts.Filter.IncludeTypes, s)
+		return nil
+	})
+	flag.Func("include-logical", "show only changes of resources with logical id matching this glob `pattern` (can be repeated); others are still applied", func(s string) error {
+		opts.Filter.IncludeLogicalIDs = append(opts.Filter.IncludeLogicalIDs, s)
+		return nil
+	})
+	flag.Func("exclude-type", "hide changes of resources of this `type` or glob pattern (can be repeated), even if included; they are still applied", func(s string) error {
+		opts.Filter.ExcludeTypes = append(opts.Filter.ExcludeTypes, s)
+		return nil
+	})
+	flag.Func("exclude-logical", "hide changes of resources with logical id matching this glob `pattern` (can be repeated), even if included; they are still applied", func(s string) error {
+		opts.Filter.ExcludeLogicalIDs = append(opts.Filter.ExcludeLogicalIDs, s)
+		return nil
+	})
+	var guard bool
+	flag.BoolVar(&guard, "guard", false, "if standard input is not a terminal and -y is not set, succeed if there are no changes, fail if there are")
+	var enableTP, disableTP bool
+	flag.BoolVar(&enableTP, "enable-termination-protection", false, "turn on stack termination protection")
+	flag.BoolVar(&disableTP, "disable-termination-protection", false, "turn off stack termination protection")
 	flag.Parse()
+	switch {
+	case enableTP && disableTP:
+		log.Fatal("-enable-termination-protection and -disable-termination-protection are mutually exclusive")
+	case enableTP:
+		opts.TerminationProtection = new(true)
+	case disableTP:
+		opts.TerminationProtection = new(false)
+	}
+	args.tags = tags
+	if allowDestructive {
+		opts.FailOnDestructive = false
+	}
+	if detectChanges && args.watch {
+		log.Fatal("-watch and -detect-changes are mutually exclusive")
+	}
+	if detectChanges || args.watch {
+		opts.DryRun = true
+	}
+	switch templateDelivery {
+	case "":
+	case "auto", "inline", "s3":
+		if opts.NoUpload || opts.ForceUpload {
+			log.Fatal("-template-delivery is mutually exclusive with -no-upload and -force-upload")
+		}
+		opts.NoUpload = templateDelivery == "inline"
+		opts.ForceUpload = templateDelivery == "s3"
+	default:
+		log.Fatalf("unsupported -template-delivery value %q, want auto, inline, or s3", templateDelivery)
+	}
+	if opts.NoUpload && opts.ForceUpload {
+		log.Fatal("-no-upload and -force-upload are mutually exclusive")
+	}
+	if opts.OutputTemplateStage != "" && opts.OutputTemplate == "" {
+		log.Fatal("-template-stage only applies to -output-template: CreateChangeSet API has no template stage, and always applies transforms")
+	}
+	if onNoChanges != "success" && onNoChanges != "fail" {
+		log.Fatalf("unsupported -on-no-changes value %q, want success or fail", onNoChanges)
+	}
+	if args.maxConcurrent > 1 && !opts.Yes && !opts.DryRun {
+		log.Fatal("-max-concurrent-stacks above 1 requires -y or -dry-run flag, as confirmations cannot be asked in parallel")
+	}
+	var guardActive bool
+	opts.Interactive = term.IsTerminal(int(os.Stdin.Fd()))
+	if !args.readOnly() && !opts.Yes && !opts.YesOnEOF && !opts.DryRun && !opts.Interactive {
+		if guard {
+			// nobody to confirm changes: only show them, and fail below
+			// if there are any
+			guardActive = true
+			opts.DryRun = true
+		} else {
+			log.Fatal("standard input is not a terminal, so confirmation cannot be asked; use -y flag to execute change set without confirmation, or -dry-run to only show changes")
+		}
+	}
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer cancel()
-	rest := flag.Args()
-	if len(rest) >= 1 {
-		rest = rest[1:]
+	if args.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, args.timeout)
+		defer cancel()
+	}
+	args.templateFile = flag.Arg(0)
+	if flag.NArg() > 1 {
+		args.params = flag.Args()[1:]
 	}
-	if err := run(ctx, name, flag.Arg(0), rest); err != nil {
+	var err error
+	if args.tracer, err = newTracer(); err != nil {
 		log.Fatal(err)
 	}
-}
-
-func run(ctx context.Context, stackName, templateFile string, rest []string) error {
-	if templateFile == "" {
-		return errors.New("want template file as the first argument")
+	// with -quiet-on-no-changes, output is held back until change set
+	// table is printed, and discarded if there are no changes
+	var held *holdBack
+	if quietOnNoChanges && !args.readOnly() {
+		if len(args.regions) != 0 || len(args.profiles) != 0 || args.batch != "" || args.watch {
+			log.Fatal("-quiet-on-no-changes is not supported with -regions, -profiles, -batch, or -watch")
+		}
+		// change set without resource changes is nothing to update, too
+		opts.NoExecuteIfEmpty = true
+		held = new(holdBack)
+		opts.Stdout = held.writer(os.Stdout, true)
+		opts.Logger = log.New(held.writer(os.Stderr, false), "", log.Flags())
+	}
+	switch {
+	case args.listChangeSets:
+		err = listChangeSets(ctx, opts.StackName, args)
+	case args.showParameters:
+		err = showParameters(ctx, opts.StackName, opts.Redact, args)
+	case args.describeChangeSet != "":
+		err = describeChangeSet(ctx, opts.StackName, args.describeChangeSet, args, opts.Format)
+	case args.compareChangeSets != "":
+		err = compareChangeSets(ctx, opts.StackName, args.compareChangeSets, args, opts.Format)
+	case args.stackResources:
+		err = listStackResources(ctx, opts.StackName, args, opts.Format)
+	case args.history:
+		err = showHistory(opts.StackName, opts.HistoryDir, args, opts.Format)
+	case args.attach != "":
+		err = attach(ctx, opts, args)
+	case args.watch:
+		err = watch(ctx, opts, args)
+	case args.batch != "":
+		err = runBatch(ctx, opts, args)
+	default:
+		err = run(ctx, opts, args)
 	}
-	if stackName == "" {
-		s := filepath.Base(templateFile)
-		stackName = strings.TrimSuffix(s, filepath.Ext(s))
+	if traceErr := args.tracer.finish(err); traceErr != nil {
+		log.Printf("WARNING: failed to export trace: %v", traceErr)
 	}
-	overrides, err := parameterOverrides(rest)
-	if err != nil {
-		return err
+	if held != nil {
+		if errors.Is(err, stackupdate.ErrNoChanges) {
+			if onNoChanges == "fail" {
+				os.Exit(3)
+			}
+			return
+		}
+		held.release()
 	}
-
-	template, err := os.ReadFile(templateFile)
-	if err != nil {
-		return err
+	if guardActive && err == nil {
+		log.Fatal("change set has changes that need review; run interactively, or with -y flag to execute it")
+	}
+	if detectChanges {
+		switch {
+		case err == nil:
+			os.Exit(2)
+		case errors.Is(err, stackupdate.ErrNoChanges):
+			log.Print(err)
+			return
+		}
 	}
-	if len(template) > 1<<20 {
-		return errors.New("template is too big")
+	if errors.Is(err, stackupdate.ErrNoChanges) {
+		log.Print(err)
+		if onNoChanges == "fail" {
+			os.Exit(3)
+		}
+		return
 	}
-
-	cfg, err := config.LoadDefaultConfig(ctx)
-	if err != nil {
-		return err
+	if e, ok := errors.AsType[*stackupdate.InsufficientCapabilitiesError](err); ok {
+		var caps []string
+		for _, c := range e.Missing {
+			caps = append(caps, string(c))
+		}
+		log.Fatalf("%v\nto acknowledge them, use -capabilities %s", err, strings.Join(caps, ","))
+	}
+	switch {
+	case errors.Is(err, stackupdate.ErrStackNotFound):
+		log.Print(err)
+		log.Print("this tool only updates existing stacks, check stack name and region")
+		os.Exit(4)
+	case errors.Is(err, stackupdate.ErrAccessDenied):
+		log.Print(err)
+		log.Print("see README for permissions required")
+		os.Exit(5)
+	case errors.Is(err, stackupdate.ErrManagedStack):
+		log.Fatalf("%v\nto update it anyway, use -allow-managed", err)
+	case errors.Is(err, stackupdate.ErrTimeout):
+		log.Print(err)
+		os.Exit(6)
+	case errors.Is(err, stackupdate.ErrIAMChanges):
+		log.Print(err)
+		os.Exit(7)
+	case errors.Is(err, stackupdate.ErrDestructiveChanges):
+		log.Printf("%v\nto apply them anyway, use -allow-destructive", err)
+		os.Exit(8)
+	case err != nil:
+		log.Fatal(err)
 	}
-	svc := cloudformation.NewFromConfig(cfg)
+}
 
-	desc, err := svc.DescribeStacks(ctx, &cloudformation.DescribeStacksInput{StackName: &stackName})
-	if err != nil {
-		return err
+// cliArgs are command line settings that are handled by run before
+// calling stackupdate.Run.
+type cliArgs struct {
+	templateFile       string
+	params             []string // key=value stack parameter overrides
+	paramsFile         string
+	paramsJSON         string
+	env                string // environment name to load parameters file for
+	envFile            string // .env file to load parameters from
+	sops               bool   // decrypt SOPS-encrypted parameter files
+	templateConfig     string
+	tagsFile           string
+	tags               map[string]string
+	substitutions      substitutionsFlag
+	profile            string
+	credentialsFile    string
+	requireAccount     string // AWS account id
+	lock               string // lock type, see acquireLock
+	endpointURL        string
+	timeout            time.Duration
+	noGitInfo          bool
+	checkPermissions   bool   // simulate IAM policies before update
+	gitRef             string // read template file at this git ref
+	preExecCmd         string // shell command to run before change set execution
+	postExecCmd        string // shell command to run after change set execution
+	hookTimeout        time.Duration
+	regions            []string
+	region             string // overrides region from the environment and profile, if set
+	regionFromTemplate bool
+	batch              string // file listing stacks to update
+	consoleDomain      string
+	writeCommitNote    bool
+	maxConcurrent      int // with -regions, -profiles, or -batch
+	strictName         bool
+	watch              bool          // re-run dry run on template changes
+	templateMaxAge     time.Duration // only checked for downloaded templates
+	profiles           []string
+	continueOnError    bool
+	tracer             *tracer // nil unless OTLP endpoint is configured
+
+	// read-only commands
+	listChangeSets    bool
+	showParameters    bool
+	diffParameters    bool   // handled by updateStack, as it needs parameters loaded by run
+	describeChangeSet string // change set name or ARN
+	compareChangeSets string // two comma-separated change set names or ARNs
+	stackResources    bool
+	history           bool
+	attach            string // stack name or change set ARN
+}
+
+// readOnly reports whether args select one of the commands that only
+// inspect a stack without updating it.
+func (a cliArgs) readOnly() bool {
+	return a.listChangeSets || a.showParameters || a.diffParameters || a.describeChangeSet != "" || a.compareChangeSets != "" || a.stackResources || a.history || a.attach != ""
+}
+
+func run(ctx context.Context, opts stackupdate.Options, args cliArgs) error {
+	templateFile := args.templateFile
+	if templateFile == "" {
+		return errors.New("want template file or url as the first argument")
 	}
-	if l := len(desc.Stacks); l != 1 {
-		return fmt.Errorf("DescribeStacks returned %d stacks, expected 1", l)
+	if args.strictName && opts.StackName == "" {
+		return errors.New("-strict-name is set, so stack name must be set explicitly: with -n flag, or stack field of -batch file entry")
 	}
-	stack := desc.Stacks[0]
-	var params []types.Parameter
-	for _, p := range stack.Parameters {
-		k := unptr(p.ParameterKey)
-		if v, ok := overrides[k]; ok {
-			params = append(params, types.Parameter{ParameterKey: &k, ParameterValue: &v})
-			delete(overrides, k)
-			continue
-		}
-		params = append(params, types.Parameter{ParameterKey: &k, UsePreviousValue: new(true)})
+	opts.StackName = stackName(opts.StackName, templateFile)
+	var lastModified time.Time
+	var err error
+	if opts.Template, lastModified, err = readTemplate(ctx, templateFile, args.gitRef); err != nil {
+		return err
+	}
+	if age := time.Since(lastModified); args.templateMaxAge > 0 && !lastModified.IsZero() && age > args.templateMaxAge {
+		logger(opts).Printf("WARNING: template was last modified %v ago, at %s, which is more than -template-max-age %v",
+			age.Round(time.Minute), lastModified.Local().Format(time.DateTime), args.templateMaxAge)
 	}
-	if len(overrides) != 0 {
-		log.Printf("stack has no parameters with these names (it's ok if your template adds them): %s", strings.Join(slices.Sorted(maps.Keys(overrides)), ", "))
-		for k, v := range overrides {
-			params = append(params, types.Parameter{ParameterKey: &k, ParameterValue: &v})
+	opts.Template = substitute(opts.Template, args.substitutions, opts.Verbose)
+	opts.Parameters = make(map[string]string)
+	opts.Tags = make(map[string]string)
+	if args.templateConfig != "" {
+		c, err := templateConfigFile(args.templateConfig)
+		if err != nil {
+			return err
 		}
+		maps.Copy(opts.Parameters, c.Parameters)
+		maps.Copy(opts.Tags, c.Tags)
+		opts.StackPolicy = c.StackPolicy
 	}
-
-	changeSetID := "cs-" + rand.Text()
-	inp := &cloudformation.CreateChangeSetInput{
-		StackName:     &stackName,
-		ChangeSetName: &changeSetID,
-		ChangeSetType: types.ChangeSetTypeUpdate,
-		Parameters:    params,
-		TemplateBody:  new(string(template)),
-		Description:   new("created using stack-update tool"),
-		Capabilities:  stack.Capabilities,
+	if args.paramsFile != "" && args.paramsJSON != "" {
+		return errors.New("-params-file and -params-json are mutually exclusive")
 	}
-
-	// Even though there's a logic below on CreateChangeSet that catches types.InsufficientCapabilitiesException,
-	// CloudFormation isn't very consistent returning it, and in some cases I've seen CreateChangeSet succeeding,
-	// and failing on the execution stage, reaching FAILED status and “Requires capabilities : [CAPABILITY_IAM]”
-	// status reason.
-	if regexp.MustCompile(`Type"?\s*:\s*"?AWS::IAM::`).Match(template) {
-		for _, cap := range [...]types.Capability{types.CapabilityCapabilityIam, types.CapabilityCapabilityNamedIam} {
-			if !slices.Contains(inp.Capabilities, cap) {
-				inp.Capabilities = append(inp.Capabilities, cap)
-				log.Println("added capability", cap)
+	if args.envFile != "" {
+		m, err := dotEnvFile(args.envFile)
+		if err != nil {
+			return err
+		}
+		declared, err := templateParameters(opts.Template)
+		if err != nil {
+			return err
+		}
+		for _, k := range slices.Sorted(maps.Keys(m)) {
+			if !declared[k] {
+				if opts.Verbose {
+					logger(opts).Printf("%s: ignoring %s, template has no such parameter", args.envFile, k)
+				}
+				continue
 			}
+			opts.Parameters[k] = m[k]
 		}
 	}
-
-	if len(template) > 51_200 { // template is too big to be provided inline
-		region, err := arnRegion(*stack.StackId)
+	if args.env != "" {
+		name, err := envParamsFile(templateFile, args.env)
 		if err != nil {
 			return err
 		}
-		url, err := uploadTemplate(ctx, s3.NewFromConfig(cfg), region, stackName, template)
+		m, err := parameterFile(ctx, name, args.sops)
 		if err != nil {
-			return fmt.Errorf("uploading template: %w", err)
+			return err
 		}
-		inp.TemplateBody = nil
-		inp.TemplateURL = &url
+		if opts.Verbose {
+			logger(opts).Printf("loaded parameters for environment %s from %s", args.env, name)
+		}
+		maps.Copy(opts.Parameters, m)
 	}
-
-	createOut, err := svc.CreateChangeSet(ctx, inp)
-	if e, ok := errors.AsType[*types.InsufficientCapabilitiesException](err); ok {
-		errtext := e.Error()
-		var updatedCaps bool
-		for _, s := range (types.Capability)("").Values() {
-			if strings.Contains(errtext, string(s)) && !slices.Contains(inp.Capabilities, s) {
-				log.Println("added missing capability", s)
-				inp.Capabilities = append(inp.Capabilities, s)
-				updatedCaps = true
-			}
+	if args.paramsFile != "" {
+		m, err := parameterFile(ctx, args.paramsFile, args.sops)
+		if err != nil {
+			return err
 		}
-		if updatedCaps {
-			createOut, err = svc.CreateChangeSet(ctx, inp)
+		maps.Copy(opts.Parameters, m)
+	}
+	if args.paramsJSON != "" {
+		m, err := parseParameters([]byte(args.paramsJSON))
+		if err != nil {
+			return fmt.Errorf("-params-json: %w", err)
 		}
+		maps.Copy(opts.Parameters, m)
 	}
+	overrides, err := parameterOverrides(args.params)
 	if err != nil {
-		return fmt.Errorf("CreateChangeSet: %w", err)
+		return err
 	}
-
-	var skipChangeSetDelete bool
-	defer func() {
-		if skipChangeSetDelete {
-			return
-		}
-		// don't use outer scope ctx because it may be already canceled
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		defer cancel()
-		if _, err := svc.DeleteChangeSet(ctx, &cloudformation.DeleteChangeSetInput{
-			StackName:     &stackName,
-			ChangeSetName: &changeSetID,
-		}); err != nil {
-			log.Printf("change set %q delete: %v", changeSetID, err)
-		}
-	}()
-
-	log.Print("waiting until change set is ready")
-
-	var descOut *cloudformation.DescribeChangeSetOutput
-
-createWaitLoop:
-	for ticker := time.NewTicker(3 * time.Second); ; {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case <-ticker.C:
-		}
-		descOut, err = svc.DescribeChangeSet(ctx, &cloudformation.DescribeChangeSetInput{ChangeSetName: createOut.Id})
+	maps.Copy(opts.Parameters, overrides)
+	if args.tagsFile != "" {
+		m, err := tagsFile(args.tagsFile)
 		if err != nil {
-			return fmt.Errorf("DescribeChangeSet: %w", err)
+			return err
 		}
-
-		switch descOut.Status {
-		case types.ChangeSetStatusCreatePending, types.ChangeSetStatusCreateInProgress: // continue polling
-		case types.ChangeSetStatusCreateComplete:
-			break createWaitLoop
-		case types.ChangeSetStatusFailed:
-			if descOut.StatusReason != nil && *descOut.StatusReason != "" {
-				if strings.Contains(*descOut.StatusReason, "DescribeEvents") {
-					if err := logChangeSetFailedEvents(ctx, svc, *createOut.Id); err != nil {
-						log.Printf("DescribeEvents: %v", err)
-					}
-				}
-				return fmt.Errorf("change set create: %v, %s", descOut.Status, *descOut.StatusReason)
+		maps.Copy(opts.Tags, m)
+	}
+	maps.Copy(opts.Tags, args.tags)
+	if !args.noGitInfo {
+		if commit, branch := gitInfo(ctx, args.gitRef); commit != "" {
+			if branch != "" {
+				opts.Description += fmt.Sprintf(" (git %s on %s)", commit, branch)
+			} else {
+				opts.Description += fmt.Sprintf(" (git %s)", commit)
 			}
-			return fmt.Errorf("change set create: %v", descOut.Status)
-		default:
-			return fmt.Errorf("unexpected change set status: %v", descOut.Status)
 		}
 	}
-
-	if s := descOut.ExecutionStatus; s != types.ExecutionStatusAvailable {
-		return fmt.Errorf("unexpected change set execution status: %v", s)
+	if args.regionFromTemplate && len(args.regions) == 0 && os.Getenv("AWS_REGION") == "" && os.Getenv("AWS_DEFAULT_REGION") == "" {
+		if args.region, err = templateRegion(opts.Template); err != nil {
+			return err
+		}
 	}
-
-	var warn bool
-	if len(descOut.Changes) != 0 {
-		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
-		fmt.Fprintln(tw, "\nAction\tReplacement\tResType\tLogicalID\tPhysicalID\t")
-		for _, c := range descOut.Changes {
-			if c.Type != types.ChangeTypeResource {
-				return fmt.Errorf("unsupported change type: %v", c.Type)
-			}
-			rc := c.ResourceChange
-			fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t\n", rc.Action, rc.Replacement, unptr(rc.ResourceType), unptr(rc.LogicalResourceId), unptr(rc.PhysicalResourceId))
-			warn = warn || rc.Action == types.ChangeActionRemove || (rc.Replacement != "" && rc.Replacement != types.ReplacementFalse)
+	if opts.TemplateFormat == "" {
+		switch strings.ToLower(path.Ext(templateBase(templateFile))) {
+		case ".json":
+			opts.TemplateFormat = "json"
+		case ".yml", ".yaml":
+			opts.TemplateFormat = "yaml"
 		}
-		tw.Flush()
 	}
 
-	fmt.Println()
-	if warn {
-		fmt.Println("\033[1mThis update may replace or remove some resources.\033[0m")
-	}
-	fmt.Print("Do you want to continue? [y/N] ")
-	input, err := bufio.NewReader(io.LimitReader(os.Stdin, 10)).ReadString('\n')
+	if len(args.profiles) == 0 {
+		return updateAccount(ctx, opts, args)
+	}
+	if args.requireAccount != "" || args.profile != "" {
+		return errors.New("-profiles is mutually exclusive with -profile and -require-account")
+	}
+	return fanOut(logger(opts), "profile", args.profiles, args.continueOnError, args.maxConcurrent, func(profile string, out io.Writer) error {
+		pargs := args
+		pargs.profile = profile
+		// regions of each profile are updated one by one, so that no more
+		// than args.maxConcurrent stacks are updated at once
+		pargs.maxConcurrent = 1
+		popts := withOutput(opts, out)
+		popts.Parameters = maps.Clone(opts.Parameters) // resolved separately in each account
+		return updateAccount(ctx, popts, pargs)
+	})
+}
+
+// updateAccount updates the stack in the account of args.profile, in the
+// default region, or in each of args.regions.
+func updateAccount(ctx context.Context, opts stackupdate.Options, args cliArgs) error {
+	begin := time.Now()
+	cfg, err := loadConfig(ctx, args)
 	if err != nil {
+		args.tracer.span("load-config", begin, err, "aws.profile", args.profile)
 		return err
 	}
-	switch strings.ToLower(strings.TrimSpace(input)) {
-	case "y", "yes":
-	default:
-		return errors.New("aborted")
-	}
+	ident, err := sts.NewFromConfig(cfg).GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	args.tracer.span("load-config", begin, err, "aws.profile", args.profile, "cloud.region", cfg.Region)
+	if err != nil {
+		return fmt.Errorf("GetCallerIdentity: %w", err)
+	}
+	account := *ident.Account
+	opts.Caller = unptr(ident.Arn)
+	if len(args.regions) == 0 {
+		logger(opts).Printf("account %s, region %s", account, cfg.Region)
+	} else {
+		logger(opts).Printf("account %s, regions %s", account, strings.Join(args.regions, ", "))
+	}
+	if args.requireAccount != "" && account != args.requireAccount {
+		return fmt.Errorf("credentials belong to account %s, but %s is required", account, args.requireAccount)
+	}
+	if len(args.regions) == 0 {
+		return updateStack(ctx, cfg, opts, args, account)
+	}
+	return fanOut(logger(opts), "region", args.regions, args.continueOnError, args.maxConcurrent, func(region string, out io.Writer) error {
+		rcfg := cfg.Copy()
+		rcfg.Region = region
+		ropts := withOutput(opts, out)
+		ropts.Parameters = maps.Clone(opts.Parameters) // resolved separately in each region
+		return updateStack(ctx, rcfg, ropts, args, account)
+	})
+}
 
-	if _, err := svc.ExecuteChangeSet(ctx, &cloudformation.ExecuteChangeSetInput{ChangeSetName: createOut.Id}); err != nil {
-		return fmt.Errorf("ExecuteChangeSet: %w", err)
+// fanOut calls fn for each of names, then prints a summary of results.
+// Unless continueOnError is set, it stops on the first failure, reporting
+// the rest as skipped. It returns the first failure, or
+// stackupdate.ErrNoChanges if all calls returned it. Kind names what names
+// are, like "region".
+//
+// If concurrency is more than 1, up to this many calls run in parallel, each
+// getting its own out to write its output to, which is logged at once when
+// the call finishes. Otherwise, calls run sequentially and out is nil.
+// Progress, output of calls, and the summary are logged to lg.
+func fanOut(lg *log.Logger, kind string, names []string, continueOnError bool, concurrency int, fn func(name string, out io.Writer) error) error {
+	results := make([]string, len(names))
+	errs := make([]error, len(names))
+	var mu sync.Mutex // guards failed and log output of parallel calls
+	var failed bool
+	sem := make(chan struct{}, max(concurrency, 1))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		sem <- struct{}{}
+		mu.Lock()
+		skip := failed && !continueOnError
+		mu.Unlock()
+		if skip {
+			<-sem
+			results[i] = "skipped"
+			continue
+		}
+		wg.Go(func() {
+			defer func() { <-sem }()
+			var buf *bytes.Buffer
+			var err error
+			if concurrency > 1 {
+				buf = new(bytes.Buffer)
+				err = fn(name, buf)
+			} else {
+				lg.Printf("%s %s", kind, name)
+				err = fn(name, nil)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if buf != nil && buf.Len() != 0 {
+				lg.Printf("%s %s output:\n%s", kind, name, buf.Bytes())
+			}
+			switch {
+			case err == nil:
+				results[i] = "updated"
+			case errors.Is(err, stackupdate.ErrNoChanges):
+				results[i] = "no changes"
+			default:
+				results[i] = "failed: " + err.Error()
+				errs[i] = err
+				failed = true
+			}
+		})
 	}
-
-	log.Print("waiting for update to complete, follow the stack update progress in the AWS console")
-	if err := openConsole(*stack.StackId); err != nil {
-		log.Printf("opening browser: %v", err)
+	wg.Wait()
+	lg.Printf("summary by %s:", kind)
+	for i, name := range names {
+		lg.Printf("\t%s: %s", name, results[i])
 	}
-
-executeWaitLoop:
-	for ticker := time.NewTicker(3 * time.Second); ; {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case <-ticker.C:
-		}
-		descOut, err = svc.DescribeChangeSet(ctx, &cloudformation.DescribeChangeSetInput{ChangeSetName: createOut.Id})
+	for i, err := range errs {
 		if err != nil {
-			return fmt.Errorf("DescribeChangeSet: %w", err)
-		}
-		switch descOut.ExecutionStatus {
-		case types.ExecutionStatusExecuteInProgress:
-		case types.ExecutionStatusExecuteComplete:
-			break executeWaitLoop
-		default:
-			return fmt.Errorf("change set execution status: %v", descOut.ExecutionStatus)
+			return fmt.Errorf("%s %s: %w", kind, names[i], err)
 		}
 	}
-	skipChangeSetDelete = true
+	if !slices.Contains(results, "updated") {
+		return stackupdate.ErrNoChanges
+	}
 	return nil
 }
 
-func uploadTemplate(ctx context.Context, svc *s3.Client, region, stackName string, body []byte) (string, error) {
-	p := s3.NewListBucketsPaginator(svc, &s3.ListBucketsInput{
-		Prefix:       new("cf-templates-"),
-		BucketRegion: &region,
-	})
-	var bucket string
-	suffix := "-" + region
-paginate:
-	for p.HasMorePages() {
-		page, err := p.NextPage(ctx)
-		if err != nil {
-			return "", err
-		}
-		for _, b := range page.Buckets {
-			if strings.HasSuffix(*b.Name, suffix) {
-				bucket = *b.Name
-				break paginate
-			}
-		}
-	}
-	if bucket == "" {
-		return "", errors.New("cannot discover bucket to upload template to")
-	}
-	key := path.Join(stackName, fmt.Sprintf("%x", sha256.Sum256(body)))
-	if _, err := svc.PutObject(ctx, &s3.PutObjectInput{
-		Bucket: &bucket,
-		Key:    &key,
-		Body:   bytes.NewReader(body),
-	}); err != nil {
-		return "", err
+// withOutput returns opts with its output and log directed to out, unless
+// out is nil.
+func withOutput(opts stackupdate.Options, out io.Writer) stackupdate.Options {
+	if out != nil {
+		opts.Stdout = out
+		opts.Logger = log.New(out, "", log.Flags())
+	}
+	return opts
+}
+
+// logger returns opts.Logger, or the default logger if it's not set.
+func logger(opts stackupdate.Options) *log.Logger {
+	if opts.Logger != nil {
+		return opts.Logger
 	}
-	return (&url.URL{
-		Scheme: "https",
-		Host:   "s3." + region + ".amazonaws.com",
-		Path:   path.Join(bucket, key),
-	}).String(), nil
+	return log.Default()
 }
 
-func logChangeSetFailedEvents(ctx context.Context, svc *cloudformation.Client, changeSetName string) error {
-	p := cloudformation.NewDescribeEventsPaginator(svc, &cloudformation.DescribeEventsInput{
-		ChangeSetName: &changeSetName,
-		Filters:       &types.EventFilter{FailedEvents: new(true)},
-	})
-	for p.HasMorePages() {
-		page, err := p.NextPage(ctx)
-		if err != nil {
+// updateStack updates the stack in cfg.Region.
+func updateStack(ctx context.Context, cfg aws.Config, opts stackupdate.Options, args cliArgs, account string) error {
+	if args.diffParameters {
+		return diffParameters(ctx, cfg, opts)
+	}
+	if args.checkPermissions {
+		if err := checkPermissions(ctx, cfg, opts, args, account); err != nil {
 			return err
 		}
-		for _, e := range page.OperationEvents {
-			log.Println(unptr(e.LogicalResourceId), e.EventType, unptr(e.ValidationName), e.ValidationStatus, unptr(e.ValidationPath), unptr(e.ValidationStatusReason))
-		}
 	}
-	return nil
-}
-
-func parameterOverrides(args []string) (map[string]string, error) {
-	var m map[string]string
-	for _, s := range args {
-		if m == nil {
-			m = map[string]string{}
+	if args.lock != "" {
+		release, err := acquireLock(ctx, cfg, logger(opts), args.lock, account, opts.StackName, opts.Caller)
+		if err != nil {
+			return err
 		}
-		k, v, ok := strings.Cut(s, "=")
-		if !ok {
-			return nil, fmt.Errorf("want key=value pair for stack parameter, got %q", s)
+		defer release()
+	}
+	cfSvc := cloudformation.NewFromConfig(cfg)
+	secretParams, err := resolveParameters(ctx, cfSvc, secretsmanager.NewFromConfig(cfg), opts.StackName, opts.Parameters)
+	if err != nil {
+		return err
+	}
+	opts.Redact = redactSecrets(opts.Redact, secretParams)
+	opts.CloudFormation = cfSvc
+	opts.S3 = s3.NewFromConfig(cfg, func(o *s3.Options) {
+		// custom endpoints, like LocalStack, usually don't support
+		// virtual-hosted–style bucket addressing
+		o.UsePathStyle = args.endpointURL != ""
+	})
+	opts.ConsoleDomain = args.consoleDomain
+	opts.OnPhase = args.tracer.phaseHook(opts.StackName, cfg.Region)
+	setHooks(&opts, args, cfg.Region)
+	opts.OpenConsole = func(stackID string) error {
+		u := stackupdate.StackURL(stackID, args.consoleDomain)
+		if u == "" {
+			return fmt.Errorf("don't know console domain for stack %s, set it with -console-domain", stackID)
 		}
-		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
-		if k == "" || v == "" {
-			return nil, fmt.Errorf("want key=value pair for stack parameter where both key and value are non-empty, got %q", s)
+		return openURL(u)
+	}
+	if c, ok := cfg.Credentials.(*aws.CredentialsCache); ok {
+		opts.RefreshCredentials = c.Invalidate
+	}
+	if !args.writeCommitNote {
+		return stackupdate.Run(ctx, opts)
+	}
+	buf := new(bytes.Buffer)
+	opts.ChangesOut = buf
+	if err := stackupdate.Run(ctx, opts); err != nil {
+		return err
+	}
+	if !opts.DryRun {
+		if err := writeCommitNote(ctx, opts.StackName, buf.Bytes()); err != nil {
+			logger(opts).Printf("WARNING: writing commit note: %v", err)
 		}
-		m[k] = v
 	}
-	return m, nil
+	return nil
 }
 
-func openConsole(arn string) error {
-	u := url.URL{
-		Scheme:   "https",
-		Host:     "console.aws.amazon.com",
-		Path:     "/go/view",
-		RawQuery: (url.Values{"arn": {arn}}).Encode(),
-	}
+// openURL opens u in a browser.
+func openURL(u string) error {
 	var openCmd string
 	var args []string
 	switch runtime.GOOS {
@@ -366,26 +786,34 @@ func openConsole(arn string) error {
 	default:
 		return fmt.Errorf("don't know how to open url on %s", runtime.GOOS)
 	}
-	return exec.Command(openCmd, append(args, u.String())...).Run()
+	return exec.Command(openCmd, append(args, u)...).Run()
+}
+
+// stackName returns name if it's set, or derives stack name from the
+// template file name otherwise.
+func stackName(name, templateFile string) string {
+	if name != "" {
+		return name
+	}
+	s := templateBase(templateFile)
+	return strings.TrimSuffix(s, path.Ext(s))
 }
 
-func arnRegion(arn string) (string, error) {
-	if !strings.HasPrefix(arn, "arn:") {
-		return "", fmt.Errorf("%q does not look like arn", arn)
+func loadConfig(ctx context.Context, args cliArgs) (aws.Config, error) {
+	var cfgOpts []func(*config.LoadOptions) error
+	if args.profile != "" {
+		cfgOpts = append(cfgOpts, config.WithSharedConfigProfile(args.profile))
 	}
-	var region string
-	var i int
-	for s := range strings.SplitSeq(arn, ":") {
-		if i == 3 {
-			region = s
-			break
-		}
-		i++
+	if args.credentialsFile != "" {
+		cfgOpts = append(cfgOpts, config.WithSharedCredentialsFiles([]string{args.credentialsFile}))
+	}
+	if args.endpointURL != "" {
+		cfgOpts = append(cfgOpts, config.WithBaseEndpoint(args.endpointURL))
 	}
-	if region == "" {
-		return "", fmt.Errorf("cannot extract region from arn %q", arn)
+	if args.region != "" {
+		cfgOpts = append(cfgOpts, config.WithRegion(args.region))
 	}
-	return region, nil
+	return config.LoadDefaultConfig(ctx, cfgOpts...)
 }
 
 func unptr[T any](v *T) T {
@@ -398,7 +826,7 @@ func unptr[T any](v *T) T {
 
 func init() {
 	flag.Usage = func() {
-		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] path/to/template.yml [key=value ...]\n", filepath.Base(os.Args[0]))
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] path/to/template.yml|https://url/of/template.yml [key=value ...]\n", filepath.Base(os.Args[0]))
 		flag.PrintDefaults()
 	}
 }
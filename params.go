@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func parameterOverrides(args []string) (map[string]string, error) {
+	var m map[string]string
+	for _, s := range args {
+		if m == nil {
+			m = map[string]string{}
+		}
+		k, v, ok := strings.Cut(s, "=")
+		if !ok {
+			return nil, fmt.Errorf("want key=value pair for stack parameter, got %q", s)
+		}
+		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+		if k == "" || v == "" {
+			return nil, fmt.Errorf("want key=value pair for stack parameter where both key and value are non-empty, got %q", s)
+		}
+		m[k] = v
+	}
+	return m, nil
+}
+
+// parameterFile loads stack parameters from a JSON file, see parseParameters
+// for supported formats. If sops is set, SOPS-encrypted files are decrypted
+// first; otherwise they are rejected.
+func parameterFile(ctx context.Context, name string, sops bool) (map[string]string, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	if sopsEncrypted(b) {
+		if !sops {
+			return nil, fmt.Errorf("%s is encrypted with SOPS, use -sops flag to decrypt it", name)
+		}
+		if b, err = sopsDecrypt(ctx, name); err != nil {
+			return nil, err
+		}
+	}
+	m, err := parseParameters(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return m, nil
+}
+
+// parseParameters parses stack parameters in either the AWS CLI format:
+//
+//	[{"ParameterKey": "Key", "ParameterValue": "Value"}, ...]
+//
+// or as a plain object:
+//
+//	{"Key": "Value", ...}
+//
+// Parameters with UsePreviousValue set are skipped, as previous values are
+// kept by default.
+func parseParameters(b []byte) (map[string]string, error) {
+	var list []struct {
+		ParameterKey     string
+		ParameterValue   string
+		UsePreviousValue bool
+	}
+	if err := json.Unmarshal(b, &list); err == nil {
+		m := make(map[string]string, len(list))
+		for _, p := range list {
+			if p.ParameterKey == "" {
+				return nil, errors.New("parameter with an empty ParameterKey")
+			}
+			if p.UsePreviousValue {
+				continue
+			}
+			m[p.ParameterKey] = p.ParameterValue
+		}
+		return m, nil
+	}
+	var m map[string]string
+	if err := json.Unmarshal(b, &m); err == nil {
+		if _, ok := m[""]; ok {
+			return nil, errors.New("parameter with an empty key")
+		}
+		return m, nil
+	}
+	return nil, errors.New(`unsupported parameters format, want either [{"ParameterKey": "Key", "ParameterValue": "Value"}, ...], or {"Key": "Value", ...}`)
+}
+
+// templateConfig is the template configuration file format used by
+// CodePipeline CloudFormation action.
+type templateConfig struct {
+	Parameters  map[string]string
+	Tags        map[string]string
+	StackPolicy json.RawMessage
+}
+
+// templateConfigFile loads template configuration file, which is a JSON
+// object with optional Parameters and Tags objects mapping keys to values,
+// and StackPolicy holding a stack policy document.
+func templateConfigFile(name string) (*templateConfig, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	var c templateConfig
+	if err := dec.Decode(&c); err != nil {
+		return nil, fmt.Errorf("%s: want JSON object with optional Parameters, Tags, and StackPolicy fields: %w", name, err)
+	}
+	if len(c.StackPolicy) != 0 {
+		var policy struct{ Statement []json.RawMessage }
+		if err := json.Unmarshal(c.StackPolicy, &policy); err != nil || len(policy.Statement) == 0 {
+			return nil, fmt.Errorf("%s: StackPolicy must be an object with a non-empty Statement list", name)
+		}
+	}
+	return &c, nil
+}
+
+// envParamsFile finds parameters file for environment env: either
+// params.ENV.json or params/ENV.json in the template directory (or in the
+// current directory, if template is an url).
+func envParamsFile(templateFile, env string) (string, error) {
+	dir := "."
+	if !isURL(templateFile) {
+		dir = filepath.Dir(templateFile)
+	}
+	candidates := []string{
+		filepath.Join(dir, "params."+env+".json"),
+		filepath.Join(dir, "params", env+".json"),
+	}
+	for _, name := range candidates {
+		if _, err := os.Stat(name); err == nil {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("no parameters file for environment %q, looked for %s", env, strings.Join(candidates, ", "))
+}
+
+// dotEnvFile loads KEY=VALUE pairs from a .env file. Empty lines and lines
+// starting with # are skipped, as is the optional "export " prefix. Values
+// may be quoted: single-quoted values are taken literally, double-quoted ones
+// support \n, \t, \", and \\ escapes. Unquoted values are trimmed, and
+// anything after " #" is treated as a comment.
+func dotEnvFile(name string) (map[string]string, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]string)
+	for i, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		k, v, ok := strings.Cut(line, "=")
+		k = strings.TrimSpace(k)
+		if !ok || k == "" || strings.ContainsAny(k, " \t") {
+			return nil, fmt.Errorf("%s:%d: want KEY=VALUE", name, i+1)
+		}
+		if v, err = dotEnvValue(strings.TrimSpace(v)); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", name, i+1, err)
+		}
+		m[k] = v
+	}
+	return m, nil
+}
+
+// dotEnvValue unquotes a single value from a .env file.
+func dotEnvValue(v string) (string, error) {
+	if v == "" {
+		return "", nil
+	}
+	switch q := v[0]; q {
+	case '\'', '"':
+		end := strings.IndexByte(v[1:], q)
+		if q == '"' {
+			end = -1
+			for i := 1; i < len(v); i++ {
+				if v[i] == '\\' {
+					i++
+					continue
+				}
+				if v[i] == '"' {
+					end = i - 1
+					break
+				}
+			}
+		}
+		if end < 0 {
+			return "", fmt.Errorf("unterminated %c quote", q)
+		}
+		if rest := strings.TrimSpace(v[end+2:]); rest != "" && !strings.HasPrefix(rest, "#") {
+			return "", fmt.Errorf("unexpected %q after quoted value", rest)
+		}
+		s := v[1 : end+1]
+		if q == '"' {
+			s = strings.NewReplacer(`\n`, "\n", `\t`, "\t", `\"`, `"`, `\\`, `\`).Replace(s)
+		}
+		return s, nil
+	}
+	if i := strings.Index(v, " #"); i >= 0 {
+		v = strings.TrimSpace(v[:i])
+	}
+	return v, nil
+}
+
+// sopsEncrypted reports whether b is a JSON object with SOPS metadata.
+func sopsEncrypted(b []byte) bool {
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(b, &m); err != nil {
+		return false
+	}
+	_, ok := m["sops"]
+	return ok
+}
+
+// sopsDecrypt decrypts file name by running sops binary.
+func sopsDecrypt(ctx context.Context, name string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "sops", "--decrypt", "--output-type", "json", name)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := bytes.TrimSpace(stderr.Bytes()); len(msg) != 0 {
+			return nil, fmt.Errorf("decrypting %s with sops: %w: %s", name, err, msg)
+		}
+		return nil, fmt.Errorf("decrypting %s with sops: %w", name, err)
+	}
+	return out, nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDotEnvFile(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		input   string
+		want    map[string]string
+		wantErr string
+	}{
+		{
+			name:  "single-quoted",
+			input: `KEY='a \n "b" # c'`,
+			want:  map[string]string{"KEY": `a \n "b" # c`},
+		},
+		{
+			name:  "double-quoted",
+			input: `KEY="line\none \"two\" \\ # not a comment" # comment`,
+			want:  map[string]string{"KEY": "line\none \"two\" \\ # not a comment"},
+		},
+		{
+			name:  "unquoted with comment",
+			input: "KEY = value with spaces # comment\nOTHER=a#b",
+			want:  map[string]string{"KEY": "value with spaces", "OTHER": "a#b"},
+		},
+		{
+			name:  "export",
+			input: "# comment\n\nexport KEY=value\nexport QUOTED='x'",
+			want:  map[string]string{"KEY": "value", "QUOTED": "x"},
+		},
+		{
+			name:    "unterminated single quote",
+			input:   "OK=1\nKEY='value",
+			wantErr: ":2: unterminated ' quote",
+		},
+		{
+			name:    "unterminated double quote",
+			input:   `KEY="value\"`,
+			wantErr: `:1: unterminated " quote`,
+		},
+		{
+			name:    "text after quoted value",
+			input:   `KEY="value" tail`,
+			wantErr: `unexpected "tail" after quoted value`,
+		},
+		{
+			name:    "no value",
+			input:   "KEY",
+			wantErr: ":1: want KEY=VALUE",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			name := filepath.Join(t.TempDir(), ".env")
+			if err := os.WriteFile(name, []byte(tc.input), 0666); err != nil {
+				t.Fatal(err)
+			}
+			got, err := dotEnvFile(name)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("got error %v, want one containing %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !maps.Equal(got, tc.want) {
+				t.Fatalf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/artyom/stack-update/stackupdate"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	iamtypes "github.com/aws/aws-sdk-go-v2/service/iam/types"
+)
+
+// requiredActions returns IAM actions the update configured by opts and
+// args likely needs, split into those on the stack, and those on other
+// resources.
+func requiredActions(opts stackupdate.Options, args cliArgs) (stackActions, otherActions []string) {
+	stackActions = []string{
+		"cloudformation:DescribeStacks",
+		"cloudformation:CreateChangeSet",
+		"cloudformation:DescribeChangeSet",
+		"cloudformation:DeleteChangeSet",
+	}
+	if !opts.DryRun {
+		stackActions = append(stackActions, "cloudformation:ExecuteChangeSet", "cloudformation:DescribeStackEvents")
+	}
+	if opts.RollbackOnTimeout {
+		stackActions = append(stackActions, "cloudformation:CancelUpdateStack")
+	}
+	if opts.OutputTemplate != "" {
+		stackActions = append(stackActions, "cloudformation:GetTemplate")
+	}
+	if opts.TerminationProtection != nil && !opts.DryRun {
+		stackActions = append(stackActions, "cloudformation:UpdateTerminationProtection")
+	}
+	if len(opts.StackPolicy) != 0 && !opts.DryRun {
+		stackActions = append(stackActions, "cloudformation:SetStackPolicy")
+	}
+	if len(opts.Template) > 51_200 || opts.ForceUpload {
+		otherActions = append(otherActions, "s3:ListAllMyBuckets", "s3:GetEncryptionConfiguration", "s3:PutObject")
+		if opts.CreateBucket {
+			otherActions = append(otherActions, "s3:CreateBucket")
+		}
+		if opts.TemplateBucketTagKey != "" {
+			otherActions = append(otherActions, "s3:GetBucketTagging")
+		}
+	}
+	if strings.HasPrefix(opts.AuditOut, "s3://") && !opts.DryRun {
+		otherActions = append(otherActions, "s3:PutObject")
+	}
+	for _, v := range opts.Parameters {
+		if strings.HasPrefix(v, "secret:") {
+			otherActions = append(otherActions, "secretsmanager:GetSecretValue")
+			break
+		}
+	}
+	if strings.HasPrefix(args.lock, "dynamodb:") {
+		otherActions = append(otherActions, "dynamodb:PutItem", "dynamodb:GetItem", "dynamodb:DeleteItem")
+	}
+	return stackActions, otherActions
+}
+
+// checkPermissions simulates IAM policies of the caller for actions the
+// update needs, and returns an error listing actions on the stack that would
+// be denied. Other actions are simulated on all resources, as their exact
+// resources, like the template bucket, are not known yet; denials of these
+// are only logged, as policies allowing them on specific resources are
+// reported as denying them.
+func checkPermissions(ctx context.Context, cfg aws.Config, opts stackupdate.Options, args cliArgs, account string) error {
+	svc := iam.NewFromConfig(cfg)
+	principal, err := principalARN(ctx, svc, opts.Caller)
+	if err != nil {
+		return fmt.Errorf("checking permissions: %w", err)
+	}
+	partition := "aws"
+	if a, err := arn.Parse(principal); err == nil {
+		partition = a.Partition
+	}
+	stackActions, otherActions := requiredActions(opts, args)
+	stackARN := fmt.Sprintf("arn:%s:cloudformation:%s:%s:stack/%s/*", partition, cfg.Region, account, opts.StackName)
+	var denied, maybeDenied []string
+	for _, c := range []struct {
+		actions   []string
+		resources []string
+		denied    *[]string
+	}{
+		{stackActions, []string{stackARN}, &denied},
+		{otherActions, nil, &maybeDenied},
+	} {
+		if len(c.actions) == 0 {
+			continue
+		}
+		p := iam.NewSimulatePrincipalPolicyPaginator(svc, &iam.SimulatePrincipalPolicyInput{
+			PolicySourceArn: &principal,
+			ActionNames:     c.actions,
+			ResourceArns:    c.resources,
+		})
+		for p.HasMorePages() {
+			page, err := p.NextPage(ctx)
+			if err != nil {
+				return fmt.Errorf("checking permissions: SimulatePrincipalPolicy: %w", err)
+			}
+			for _, r := range page.EvaluationResults {
+				if r.EvalDecision != iamtypes.PolicyEvaluationDecisionTypeAllowed {
+					*c.denied = append(*c.denied, fmt.Sprintf("%s (%s)", unptr(r.EvalActionName), r.EvalDecision))
+				}
+			}
+		}
+	}
+	if len(maybeDenied) != 0 {
+		logger(opts).Printf("WARNING: %s may be denied, unless allowed on specific resources: %s", principal, strings.Join(maybeDenied, ", "))
+	}
+	if len(denied) != 0 {
+		return fmt.Errorf("%w: %s would be denied: %s", stackupdate.ErrAccessDenied, principal, strings.Join(denied, ", "))
+	}
+	if opts.Verbose {
+		logger(opts).Printf("%s is allowed actions on the stack the update needs", principal)
+	}
+	return nil
+}
+
+// principalARN returns ARN of IAM user or role for caller ARN returned by
+// GetCallerIdentity, which for roles is an STS assumed-role ARN.
+func principalARN(ctx context.Context, svc *iam.Client, caller string) (string, error) {
+	a, err := arn.Parse(caller)
+	if err != nil {
+		return "", err
+	}
+	if a.Service != "sts" {
+		return caller, nil
+	}
+	// arn:aws:sts::account:assumed-role/RoleName/SessionName
+	kind, rest, _ := strings.Cut(a.Resource, "/")
+	roleName, _, _ := strings.Cut(rest, "/")
+	if kind != "assumed-role" || roleName == "" {
+		return "", fmt.Errorf("cannot simulate policies of %s", caller)
+	}
+	// role ARN may include a path, which assumed-role ARN lacks
+	if out, err := svc.GetRole(ctx, &iam.GetRoleInput{RoleName: &roleName}); err == nil && out.Role != nil {
+		return unptr(out.Role.Arn), nil
+	}
+	return arn.ARN{Partition: a.Partition, Service: "iam", AccountID: a.AccountID, Resource: "role/" + roleName}.String(), nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// holdBack holds output back until it's released, so that it can be
+// discarded if it turns out to be of no interest.
+type holdBack struct {
+	mu       sync.Mutex
+	released bool
+	held     []heldWrite
+}
+
+type heldWrite struct {
+	dst io.Writer
+	p   []byte
+}
+
+// writer returns a writer to dst that holds writes back until h is
+// released. If releases is set, the first write to it releases h.
+func (h *holdBack) writer(dst io.Writer, releases bool) io.Writer {
+	return holdWriter{h: h, dst: dst, releases: releases}
+}
+
+// release writes held output, and makes further writes pass through.
+func (h *holdBack) release() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.releaseLocked()
+}
+
+func (h *holdBack) releaseLocked() {
+	if h.released {
+		return
+	}
+	h.released = true
+	for _, w := range h.held {
+		w.dst.Write(w.p)
+	}
+	h.held = nil
+}
+
+type holdWriter struct {
+	h        *holdBack
+	dst      io.Writer
+	releases bool
+}
+
+func (w holdWriter) Write(p []byte) (int, error) {
+	w.h.mu.Lock()
+	defer w.h.mu.Unlock()
+	if w.releases {
+		w.h.releaseLocked()
+	}
+	if w.h.released {
+		return w.dst.Write(p)
+	}
+	w.h.held = append(w.h.held, heldWrite{dst: w.dst, p: bytes.Clone(p)})
+	return len(p), nil
+}
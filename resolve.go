@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/artyom/stack-update/stackupdate"
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	smtypes "github.com/aws/aws-sdk-go-v2/service/secretsmanager/types"
+)
+
+// resolveParameters replaces parameter values that reference other sources
+// with values taken from these sources. Supported references:
+//
+//	output:StackName.OutputKey	output value of another stack
+//	env:NAME	value of environment variable, which must be set
+//	env:NAME:-fallback	value of environment variable, or fallback if it's unset
+//	secret:NameOrARN	value of Secrets Manager secret
+//	secret:NameOrARN:key	value of key of Secrets Manager secret holding JSON object
+//
+// Output references to the stack being updated, currentStack, are rejected,
+// as such outputs don't reflect the pending update.
+//
+// It returns names of parameters resolved from secrets.
+func resolveParameters(ctx context.Context, svc *cloudformation.Client, smSvc *secretsmanager.Client, currentStack string, params map[string]string) (secretParams []string, err error) {
+	outputs := make(map[string]map[string]string) // stack name to its outputs
+	for _, k := range slices.Sorted(maps.Keys(params)) {
+		if ref, ok := strings.CutPrefix(params[k], "secret:"); ok {
+			v, err := secretValue(ctx, smSvc, ref)
+			if err != nil {
+				return nil, fmt.Errorf("parameter %s: %w", k, err)
+			}
+			params[k] = v
+			secretParams = append(secretParams, k)
+			continue
+		}
+		if ref, ok := strings.CutPrefix(params[k], "env:"); ok {
+			name, fallback, hasFallback := strings.Cut(ref, ":-")
+			if name == "" {
+				return nil, fmt.Errorf("parameter %s: want env:NAME or env:NAME:-fallback, got %q", k, params[k])
+			}
+			v, ok := os.LookupEnv(name)
+			switch {
+			case ok:
+				params[k] = v
+			case hasFallback:
+				params[k] = fallback
+			default:
+				return nil, fmt.Errorf("parameter %s: environment variable %s is not set", k, name)
+			}
+			continue
+		}
+		ref, ok := strings.CutPrefix(params[k], "output:")
+		if !ok {
+			continue
+		}
+		stackName, outputKey, ok := strings.Cut(ref, ".")
+		if !ok || stackName == "" || outputKey == "" {
+			return nil, fmt.Errorf("parameter %s: want output:StackName.OutputKey, got %q", k, params[k])
+		}
+		if stackName == currentStack {
+			return nil, fmt.Errorf("parameter %s: %q references output of the stack being updated, which would be its value before this update", k, params[k])
+		}
+		m, ok := outputs[stackName]
+		if !ok {
+			var err error
+			if m, err = stackOutputs(ctx, svc, stackName); err != nil {
+				return nil, fmt.Errorf("parameter %s: %w", k, err)
+			}
+			outputs[stackName] = m
+		}
+		v, ok := m[outputKey]
+		if !ok {
+			return nil, fmt.Errorf("parameter %s: stack %s has no output %q", k, stackName, outputKey)
+		}
+		params[k] = v
+	}
+	return secretParams, nil
+}
+
+// redactSecrets returns re extended to also match names of parameters with
+// values taken from secrets, which must never be shown.
+func redactSecrets(re *regexp.Regexp, secretParams []string) *regexp.Regexp {
+	if len(secretParams) == 0 {
+		return re
+	}
+	var names []string
+	for _, k := range secretParams {
+		names = append(names, regexp.QuoteMeta(k))
+	}
+	pattern := "^(?:" + strings.Join(names, "|") + ")$"
+	if re != nil {
+		pattern = re.String() + "|" + pattern
+	}
+	return regexp.MustCompile(pattern)
+}
+
+// secretValue returns value of Secrets Manager secret referenced as NameOrARN,
+// or NameOrARN:key for a key of secret holding JSON object.
+func secretValue(ctx context.Context, svc *secretsmanager.Client, ref string) (string, error) {
+	id, key := ref, ""
+	if strings.HasPrefix(ref, "arn:") {
+		// arn:partition:secretsmanager:region:account:secret:name
+		if f := strings.SplitN(ref, ":", 8); len(f) == 8 {
+			id, key = strings.Join(f[:7], ":"), f[7]
+		}
+	} else {
+		id, key, _ = strings.Cut(ref, ":") // secret names can't have colons
+	}
+	if id == "" {
+		return "", fmt.Errorf("want secret:NameOrARN or secret:NameOrARN:key, got %q", "secret:"+ref)
+	}
+	out, err := svc.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{SecretId: &id})
+	if err != nil {
+		if _, ok := errors.AsType[*smtypes.ResourceNotFoundException](err); ok {
+			return "", fmt.Errorf("secret %s not found", id)
+		}
+		return "", fmt.Errorf("reading secret %s: %w", id, err)
+	}
+	if out.SecretString == nil {
+		return "", fmt.Errorf("secret %s has no string value", id)
+	}
+	if key == "" {
+		return *out.SecretString, nil
+	}
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(*out.SecretString), &m); err != nil {
+		return "", fmt.Errorf("secret %s is not a JSON object, so its key %q cannot be used", id, key)
+	}
+	raw, ok := m[key]
+	if !ok {
+		return "", fmt.Errorf("secret %s has no key %q", id, key)
+	}
+	var v string
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return string(raw), nil // number or boolean
+	}
+	return v, nil
+}
+
+func stackOutputs(ctx context.Context, svc *cloudformation.Client, stackName string) (map[string]string, error) {
+	stack, err := stackupdate.DescribeStack(ctx, svc, stackName)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]string)
+	for _, o := range stack.Outputs {
+		m[unptr(o.OutputKey)] = unptr(o.OutputValue)
+	}
+	return m, nil
+}
@@ -0,0 +1,86 @@
+package stackupdate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation/types"
+)
+
+// Attach waits for a change set execution that is already in progress to
+// complete, reporting stack events and progress as Run does after it
+// executes a change set. The target is either a stack name or id, in which
+// case the change set the stack is being updated with is looked up, or a
+// change set ARN. Attach only uses the following fields of opts:
+// CloudFormation, Events, EventsOnFailure, Progress, EventsSince, TailLines,
+// ExecuteTimeout, PollInterval, RefreshCredentials, ConsoleDomain, and
+// Logger.
+//
+// Progress only counts resources updated since Attach was called.
+func Attach(ctx context.Context, opts Options, target string) error {
+	if target == "" {
+		return errors.New("empty stack name or change set ARN")
+	}
+	if opts.CloudFormation == nil {
+		return errors.New("nil CloudFormation client")
+	}
+	if opts.Logger == nil {
+		opts.Logger = log.Default()
+	}
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = 3 * time.Second
+	}
+	svc, logger := opts.CloudFormation, opts.Logger
+	changeSetID := target
+	if !strings.HasPrefix(target, "arn:") || !strings.Contains(target, ":changeSet/") {
+		stack, err := DescribeStack(ctx, svc, target)
+		if err != nil {
+			return classifyError(err)
+		}
+		if !strings.HasSuffix(string(stack.StackStatus), "_IN_PROGRESS") {
+			return fmt.Errorf("stack %s has no operation in progress, its status is %v", target, stack.StackStatus)
+		}
+		if stack.ChangeSetId == nil {
+			return fmt.Errorf("stack %s operation in progress is not a change set execution", target)
+		}
+		changeSetID = *stack.ChangeSetId
+	}
+	desc, changes, err := changeSetChanges(ctx, svc, "", changeSetID)
+	if err != nil {
+		return classifyError(err)
+	}
+	switch desc.ExecutionStatus {
+	case types.ExecutionStatusExecuteInProgress:
+	case types.ExecutionStatusExecuteComplete:
+		logger.Printf("change set %s has already been executed", changeSetID)
+		return nil
+	default:
+		return fmt.Errorf("change set %s is not being executed, its execution status is %v", changeSetID, desc.ExecutionStatus)
+	}
+	begin := time.Now()
+	eventsSince := begin
+	if !opts.EventsSince.IsZero() {
+		eventsSince = opts.EventsSince
+	}
+	stackID := unptr(desc.StackId)
+	logger.Printf("attached to execution of change set %s, waiting for update to complete", unptr(desc.ChangeSetName))
+	if u := StackURL(stackID, opts.ConsoleDomain); u != "" {
+		logger.Printf("follow the stack update progress in the AWS console: %s", u)
+	}
+	executeCtx, cancel := contextWithTimeout(ctx, opts.ExecuteTimeout)
+	defer cancel()
+	if err := waitExecution(executeCtx, opts, stackID, changeSetID, changes, eventsSince, nil); err != nil {
+		return classifyError(err)
+	}
+	elapsed := time.Since(begin).Round(time.Second)
+	if stack, err := DescribeStack(ctx, svc, stackID); err == nil {
+		logger.Printf("stack update finished %v after attaching, stack status: %v", elapsed, stack.StackStatus)
+	} else {
+		logger.Printf("stack update finished %v after attaching, but checking stack status failed: %v", elapsed, err)
+	}
+	return nil
+}
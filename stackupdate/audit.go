@@ -0,0 +1,103 @@
+package stackupdate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// auditRecord describes an executed change set.
+type auditRecord struct {
+	Time        time.Time        `json:"time"`
+	Caller      string           `json:"caller,omitempty"`
+	StackName   string           `json:"stackName"`
+	StackID     string           `json:"stackId"`
+	ChangeSetID string           `json:"changeSetId"`
+	Parameters  []auditParameter `json:"parameters,omitempty"`
+	Changes     []auditChange    `json:"changes,omitempty"`
+}
+
+type auditParameter struct {
+	Key              string `json:"key"`
+	Value            string `json:"value,omitempty"`
+	UsePreviousValue bool   `json:"usePreviousValue,omitempty"`
+}
+
+type auditChange struct {
+	Action             types.ChangeAction `json:"action"`
+	Replacement        types.Replacement  `json:"replacement,omitempty"`
+	ResourceType       string             `json:"resourceType"`
+	LogicalResourceID  string             `json:"logicalResourceId"`
+	PhysicalResourceID string             `json:"physicalResourceId,omitempty"`
+}
+
+func newAuditRecord(caller string, stack types.Stack, changeSetID string, params []types.Parameter, changes []types.Change, redactRe *regexp.Regexp) auditRecord {
+	rec := auditRecord{
+		Time:        time.Now().UTC(),
+		Caller:      caller,
+		StackName:   unptr(stack.StackName),
+		StackID:     unptr(stack.StackId),
+		ChangeSetID: changeSetID,
+	}
+	for _, p := range params {
+		rec.Parameters = append(rec.Parameters, auditParameter{
+			Key:              unptr(p.ParameterKey),
+			Value:            redact(redactRe, unptr(p.ParameterKey), unptr(p.ParameterValue)),
+			UsePreviousValue: unptr(p.UsePreviousValue),
+		})
+	}
+	for _, c := range changes {
+		if c.ResourceChange == nil {
+			continue
+		}
+		rc := c.ResourceChange
+		rec.Changes = append(rec.Changes, auditChange{
+			Action:             rc.Action,
+			Replacement:        rc.Replacement,
+			ResourceType:       unptr(rc.ResourceType),
+			LogicalResourceID:  unptr(rc.LogicalResourceId),
+			PhysicalResourceID: unptr(rc.PhysicalResourceId),
+		})
+	}
+	return rec
+}
+
+// writeAuditRecord saves rec as JSON to dst, which is either a local file
+// path, or an s3://bucket/key url.
+func writeAuditRecord(ctx context.Context, svc S3API, dst string, rec auditRecord) error {
+	b, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	if !strings.HasPrefix(dst, "s3://") {
+		return os.WriteFile(dst, b, 0666)
+	}
+	u, err := url.Parse(dst)
+	if err != nil {
+		return err
+	}
+	key := strings.TrimPrefix(u.Path, "/")
+	if u.Host == "" || key == "" {
+		return errors.New("want s3://bucket/key url")
+	}
+	if svc == nil {
+		return errors.New("no S3 client configured")
+	}
+	_, err = svc.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      &u.Host,
+		Key:         &key,
+		Body:        bytes.NewReader(b),
+		ContentType: new("application/json"),
+	})
+	return err
+}
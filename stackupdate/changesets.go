@@ -0,0 +1,210 @@
+package stackupdate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation"
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation/types"
+)
+
+// ListChangeSets writes a table of existing stack change sets to w.
+func ListChangeSets(ctx context.Context, svc cloudformation.ListChangeSetsAPIClient, stackName string, w io.Writer) error {
+	p := cloudformation.NewListChangeSetsPaginator(svc, &cloudformation.ListChangeSetsInput{StackName: &stackName})
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "Name\tStatus\tExecutionStatus\tCreated\tDescription\t")
+	var n int
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, cs := range page.Summaries {
+			var created string
+			if cs.CreationTime != nil {
+				created = cs.CreationTime.Local().Format(time.DateTime)
+			}
+			fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t\n", unptr(cs.ChangeSetName), cs.Status, cs.ExecutionStatus, created, unptr(cs.Description))
+			n++
+		}
+	}
+	if n == 0 {
+		_, err := fmt.Fprintf(w, "stack %s has no change sets\n", stackName)
+		return err
+	}
+	return tw.Flush()
+}
+
+// DescribeChangeSet writes status and changes of an existing change set to
+// w, without executing it. The changeSet is either a change set ARN, or its
+// name, in which case stackName must also be set. Format is either "table"
+// (default), "diff" (see Options.Format), or "json".
+func DescribeChangeSet(ctx context.Context, svc cloudformation.DescribeChangeSetAPIClient, stackName, changeSet string, w io.Writer, format string) error {
+	switch format {
+	case "", "table", "diff", "json":
+	default:
+		return fmt.Errorf("unsupported format %q, want table, diff, or json", format)
+	}
+	desc, changes, err := changeSetChanges(ctx, svc, stackName, changeSet)
+	if err != nil {
+		return err
+	}
+	if format == "json" {
+		var rcs []*types.ResourceChange
+		for _, c := range changes {
+			if c.ResourceChange != nil {
+				rcs = append(rcs, c.ResourceChange)
+			}
+		}
+		var created *time.Time
+		if desc.CreationTime != nil {
+			created = new(desc.CreationTime.UTC())
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(struct {
+			ChangeSetName   string                `json:"changeSetName"`
+			ChangeSetID     string                `json:"changeSetId"`
+			StackName       string                `json:"stackName"`
+			Created         *time.Time            `json:"created,omitempty"`
+			Description     string                `json:"description,omitempty"`
+			Status          types.ChangeSetStatus `json:"status"`
+			StatusReason    string                `json:"statusReason,omitempty"`
+			ExecutionStatus types.ExecutionStatus `json:"executionStatus"`
+			Changes         []auditChange         `json:"changes"`
+		}{
+			ChangeSetName:   unptr(desc.ChangeSetName),
+			ChangeSetID:     unptr(desc.ChangeSetId),
+			StackName:       unptr(desc.StackName),
+			Created:         created,
+			Description:     unptr(desc.Description),
+			Status:          desc.Status,
+			StatusReason:    unptr(desc.StatusReason),
+			ExecutionStatus: desc.ExecutionStatus,
+			Changes:         toAuditChanges(rcs),
+		})
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Change set:\t%s\n", unptr(desc.ChangeSetName))
+	fmt.Fprintf(tw, "Stack:\t%s\n", unptr(desc.StackName))
+	if desc.CreationTime != nil {
+		fmt.Fprintf(tw, "Created:\t%s\n", desc.CreationTime.Local().Format(time.DateTime))
+	}
+	if d := unptr(desc.Description); d != "" {
+		fmt.Fprintf(tw, "Description:\t%s\n", d)
+	}
+	fmt.Fprintf(tw, "Status:\t%v\n", desc.Status)
+	if r := unptr(desc.StatusReason); r != "" {
+		fmt.Fprintf(tw, "Status reason:\t%s\n", r)
+	}
+	fmt.Fprintf(tw, "Execution status:\t%v\n", desc.ExecutionStatus)
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	return writeChanges(w, changes, "", format, ChangeFilter{})
+}
+
+// CompareChangeSets writes resource changes that are in one of the two
+// change sets, but not in the other, to w, either as tables, or as JSON if
+// asJSON is set. Changes are matched by logical resource id and action.
+// Change sets are either ARNs, or names, in which case stackName must also
+// be set.
+func CompareChangeSets(ctx context.Context, svc cloudformation.DescribeChangeSetAPIClient, stackName, first, second string, w io.Writer, asJSON bool) error {
+	_, changes1, err := changeSetChanges(ctx, svc, stackName, first)
+	if err != nil {
+		return err
+	}
+	_, changes2, err := changeSetChanges(ctx, svc, stackName, second)
+	if err != nil {
+		return err
+	}
+	only1, only2 := changesDifference(changes1, changes2), changesDifference(changes2, changes1)
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(struct {
+			OnlyInFirst  []auditChange `json:"onlyInFirst"`
+			OnlyInSecond []auditChange `json:"onlyInSecond"`
+		}{toAuditChanges(only1), toAuditChanges(only2)})
+	}
+	for _, d := range []struct {
+		name string
+		rcs  []*types.ResourceChange
+	}{{first, only1}, {second, only2}} {
+		if len(d.rcs) == 0 {
+			fmt.Fprintf(w, "No changes only in %s\n\n", d.name)
+			continue
+		}
+		fmt.Fprintf(w, "Only in %s:\n", d.name)
+		writeChangeRows(w, d.rcs, "", true)
+		fmt.Fprintln(w)
+	}
+	return nil
+}
+
+// toAuditChanges converts resource changes to their JSON representation,
+// never returning nil.
+func toAuditChanges(rcs []*types.ResourceChange) []auditChange {
+	out := []auditChange{}
+	for _, rc := range rcs {
+		out = append(out, auditChange{
+			Action:             rc.Action,
+			Replacement:        rc.Replacement,
+			ResourceType:       unptr(rc.ResourceType),
+			LogicalResourceID:  unptr(rc.LogicalResourceId),
+			PhysicalResourceID: unptr(rc.PhysicalResourceId),
+		})
+	}
+	return out
+}
+
+// changesDifference returns resource changes from a that have no change with
+// the same logical resource id and action in b.
+func changesDifference(a, b []types.Change) []*types.ResourceChange {
+	type key struct {
+		id     string
+		action types.ChangeAction
+	}
+	seen := make(map[key]bool, len(b))
+	for _, c := range b {
+		if rc := c.ResourceChange; rc != nil {
+			seen[key{unptr(rc.LogicalResourceId), rc.Action}] = true
+		}
+	}
+	var out []*types.ResourceChange
+	for _, c := range a {
+		if rc := c.ResourceChange; rc != nil && !seen[key{unptr(rc.LogicalResourceId), rc.Action}] {
+			out = append(out, rc)
+		}
+	}
+	return out
+}
+
+// changeSetChanges returns change set description and all of its changes.
+func changeSetChanges(ctx context.Context, svc cloudformation.DescribeChangeSetAPIClient, stackName, changeSet string) (*cloudformation.DescribeChangeSetOutput, []types.Change, error) {
+	inp := &cloudformation.DescribeChangeSetInput{ChangeSetName: &changeSet}
+	if stackName != "" {
+		inp.StackName = &stackName
+	}
+	p := cloudformation.NewDescribeChangeSetPaginator(svc, inp)
+	var desc *cloudformation.DescribeChangeSetOutput
+	var changes []types.Change
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		if desc == nil {
+			desc = page
+		}
+		changes = append(changes, page.Changes...)
+	}
+	if desc == nil {
+		return nil, nil, fmt.Errorf("change set %q not found", changeSet)
+	}
+	return desc, changes, nil
+}
@@ -0,0 +1,59 @@
+package stackupdate
+
+import (
+	"net/url"
+	"strings"
+)
+
+// consoleDomains maps AWS partitions to domains of their AWS consoles.
+// Isolated partitions are not listed: use an explicit domain for them.
+var consoleDomains = map[string]string{
+	"aws":        "console.aws.amazon.com",
+	"aws-cn":     "console.amazonaws.cn",
+	"aws-us-gov": "console.amazonaws-us-gov.com",
+}
+
+// StackURL returns a link to the stack page of the CloudFormation console.
+// The domain is the console domain, like console.aws.amazon.com; if empty,
+// it's derived from the partition of the stack id. It returns an empty
+// string if stack id is not a valid ARN, or the domain is not known.
+func StackURL(stackID, domain string) string {
+	base := consoleBase(stackID, domain)
+	if base == "" {
+		return ""
+	}
+	return base + "#/stacks/stackinfo?" + url.Values{"stackId": {stackID}}.Encode()
+}
+
+// changeSetURL returns a link to the change set page of the CloudFormation
+// console, see StackURL.
+func changeSetURL(stackID, changeSetID, domain string) string {
+	base := consoleBase(stackID, domain)
+	if base == "" {
+		return ""
+	}
+	return base + "#/stacks/changesets/changes?" + url.Values{"stackId": {stackID}, "changeSetId": {changeSetID}}.Encode()
+}
+
+// consoleBase returns CloudFormation console url in the region of the stack,
+// to append a fragment to.
+func consoleBase(stackID, domain string) string {
+	// arn:partition:cloudformation:region:account:stack/name/id
+	f := strings.Split(stackID, ":")
+	if len(f) < 6 || f[0] != "arn" {
+		return ""
+	}
+	partition, region := f[1], f[3]
+	if domain == "" {
+		domain = consoleDomains[partition]
+	}
+	if domain == "" {
+		return ""
+	}
+	return (&url.URL{
+		Scheme:   "https",
+		Host:     region + "." + domain,
+		Path:     "/cloudformation/home",
+		RawQuery: url.Values{"region": {region}}.Encode(),
+	}).String()
+}
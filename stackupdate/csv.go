@@ -0,0 +1,38 @@
+package stackupdate
+
+import (
+	"encoding/csv"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation/types"
+)
+
+// writeChangesCSV saves resource changes to file name as CSV, with the same
+// columns as the changes table, and a header row.
+func writeChangesCSV(name string, changes []types.Change) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := csv.NewWriter(f)
+	w.Write([]string{"Action", "Replacement", "ResourceType", "LogicalID", "PhysicalID"})
+	for _, c := range changes {
+		rc := c.ResourceChange
+		if rc == nil {
+			continue
+		}
+		w.Write([]string{
+			string(rc.Action),
+			string(rc.Replacement),
+			unptr(rc.ResourceType),
+			unptr(rc.LogicalResourceId),
+			unptr(rc.PhysicalResourceId),
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,66 @@
+package stackupdate
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation/types"
+)
+
+// ChangeFilter selects which resource changes are shown. It only affects
+// display: the change set is executed in full.
+//
+// All fields hold glob patterns, as supported by path.Match, like
+// AWS::Lambda::* or Api*. If any of the include patterns are set, only
+// changes matching them are shown. Changes matching exclude patterns are
+// never shown.
+type ChangeFilter struct {
+	IncludeTypes      []string // resource types to show
+	IncludeLogicalIDs []string // logical ids of resources to show
+	ExcludeTypes      []string // resource types to hide
+	ExcludeLogicalIDs []string // logical ids of resources to hide
+}
+
+// show reports whether the resource change passes the filter.
+func (f ChangeFilter) show(rc *types.ResourceChange) bool {
+	typ, id := unptr(rc.ResourceType), unptr(rc.LogicalResourceId)
+	if matchAny(f.ExcludeTypes, typ) || matchAny(f.ExcludeLogicalIDs, id) {
+		return false
+	}
+	if len(f.IncludeTypes) == 0 && len(f.IncludeLogicalIDs) == 0 {
+		return true
+	}
+	return matchAny(f.IncludeTypes, typ) || matchAny(f.IncludeLogicalIDs, id)
+}
+
+// validate checks that all patterns are well-formed.
+func (f ChangeFilter) validate() error {
+	for _, patterns := range [][]string{f.IncludeTypes, f.IncludeLogicalIDs, f.ExcludeTypes, f.ExcludeLogicalIDs} {
+		for _, p := range patterns {
+			if _, err := path.Match(p, ""); err != nil {
+				return fmt.Errorf("change filter pattern %q: %w", p, err)
+			}
+		}
+	}
+	return nil
+}
+
+func matchAny(patterns []string, s string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// apply returns changes that pass the filter.
+func (f ChangeFilter) apply(changes []types.Change) []types.Change {
+	var out []types.Change
+	for _, c := range changes {
+		if c.ResourceChange == nil || f.show(c.ResourceChange) {
+			out = append(out, c)
+		}
+	}
+	return out
+}
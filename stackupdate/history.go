@@ -0,0 +1,139 @@
+package stackupdate
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// maxHistoryEntries is how many latest entries are kept in a stack history
+// file.
+const maxHistoryEntries = 50
+
+// historyEntry describes a change set executed by Run, as saved to a stack
+// history file.
+type historyEntry struct {
+	Time         time.Time      `json:"time"`
+	StackID      string         `json:"stackId"`
+	Region       string         `json:"region,omitempty"`
+	Account      string         `json:"account,omitempty"`
+	ChangeSetID  string         `json:"changeSetId"`
+	Counts       map[string]int `json:"counts,omitempty"` // number of changes per action
+	Replacements []string       `json:"replacements,omitempty"`
+	Changes      []auditChange  `json:"changes,omitempty"`
+}
+
+// historyFile returns the name of the stack history file in dir.
+func historyFile(dir, stackName string) string {
+	return filepath.Join(dir, stackName+".json")
+}
+
+func readHistory(name string) ([]historyEntry, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var entries []historyEntry
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return entries, nil
+}
+
+// appendHistory adds an entry describing the update recorded in sum to
+// the stack history file in dir, keeping only the latest entries.
+func appendHistory(dir string, sum *runSummary) error {
+	name := historyFile(dir, sum.StackName)
+	entries, err := readHistory(name)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	e := historyEntry{
+		Time:         time.Now().UTC(),
+		StackID:      sum.StackID,
+		Region:       sum.Region,
+		Account:      sum.Account,
+		ChangeSetID:  sum.ChangeSetID,
+		Counts:       sum.Counts,
+		Replacements: sum.Replacements,
+	}
+	for _, c := range sum.changes {
+		if rc := c.ResourceChange; rc != nil {
+			e.Changes = append(e.Changes, auditChange{
+				Action:             rc.Action,
+				Replacement:        rc.Replacement,
+				ResourceType:       unptr(rc.ResourceType),
+				LogicalResourceID:  unptr(rc.LogicalResourceId),
+				PhysicalResourceID: unptr(rc.PhysicalResourceId),
+			})
+		}
+	}
+	entries = append(entries, e)
+	if len(entries) > maxHistoryEntries {
+		entries = entries[len(entries)-maxHistoryEntries:]
+	}
+	b, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	return os.WriteFile(name, append(b, '\n'), 0666)
+}
+
+// History writes change sets executed on the stack, as recorded in history
+// files in dir (see Options.HistoryDir), to w, latest first. It writes them
+// either as a table, or as JSON if asJSON is set. With the table, resource
+// changes are listed for the latest change set only.
+func History(dir, stackName string, w io.Writer, asJSON bool) error {
+	entries, err := readHistory(historyFile(dir, stackName))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	slices.Reverse(entries)
+	if asJSON {
+		if entries == nil {
+			entries = []historyEntry{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(entries)
+	}
+	if len(entries) == 0 {
+		_, err := fmt.Fprintf(w, "no recorded history for stack %s in %s\n", stackName, dir)
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "Time\tRegion\tChanges\tReplacements\tChangeSet\t")
+	for _, e := range entries {
+		var counts []string
+		for _, a := range slices.Sorted(maps.Keys(e.Counts)) {
+			counts = append(counts, fmt.Sprintf("%s %d", a, e.Counts[a]))
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t\n", e.Time.Local().Format(time.DateTime), e.Region,
+			strings.Join(counts, ", "), len(e.Replacements), e.ChangeSetID)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if len(entries[0].Changes) == 0 {
+		return nil
+	}
+	fmt.Fprintf(w, "\nChanges of the latest change set:\n")
+	tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "Action\tLogicalId\tType\tReplacement\t")
+	for _, c := range entries[0].Changes {
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t\n", c.Action, c.LogicalResourceID, c.ResourceType, c.Replacement)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,154 @@
+//go:build integration
+
+package stackupdate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation"
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Integration tests run the full update flow against LocalStack, at
+// LOCALSTACK_ENDPOINT, or http://localhost:4566 by default:
+//
+//	docker run --rm -d -p 4566:4566 localstack/localstack
+//	go test -tags integration ./stackupdate
+
+const integrationTemplate = `Parameters:
+  Value:
+    Type: String
+Resources:
+  Param:
+    Type: AWS::SSM::Parameter
+    Properties:
+      Type: String
+      Value: !Ref Value
+`
+
+func integrationConfig(t *testing.T) aws.Config {
+	t.Helper()
+	endpoint := os.Getenv("LOCALSTACK_ENDPOINT")
+	if endpoint == "" {
+		endpoint = "http://localhost:4566"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		t.Fatalf("LOCALSTACK_ENDPOINT: %v", err)
+	}
+	conn, err := net.DialTimeout("tcp", u.Host, time.Second)
+	if err != nil {
+		t.Skipf("LocalStack is not available at %s: %v", endpoint, err)
+	}
+	conn.Close()
+	cfg, err := config.LoadDefaultConfig(t.Context(),
+		config.WithRegion("us-east-1"),
+		config.WithBaseEndpoint(endpoint),
+		config.WithCredentialsProvider(aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "test", SecretAccessKey: "test"}, nil
+		})),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// createTestStack creates a stack from integrationTemplate and waits for
+// its creation to complete, deleting it once the test ends.
+func createTestStack(t *testing.T, svc *cloudformation.Client) string {
+	t.Helper()
+	name := fmt.Sprintf("stack-update-test-%d", time.Now().UnixNano())
+	_, err := svc.CreateStack(t.Context(), &cloudformation.CreateStackInput{
+		StackName:    &name,
+		TemplateBody: new(integrationTemplate),
+		Parameters:   []types.Parameter{{ParameterKey: new("Value"), ParameterValue: new("one")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		svc.DeleteStack(context.Background(), &cloudformation.DeleteStackInput{StackName: &name})
+	})
+	w := cloudformation.NewStackCreateCompleteWaiter(svc, func(o *cloudformation.StackCreateCompleteWaiterOptions) {
+		o.MinDelay = time.Second
+	})
+	if err := w.Wait(t.Context(), &cloudformation.DescribeStacksInput{StackName: &name}, 2*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func integrationOptions(svc *cloudformation.Client, stackName string) Options {
+	return Options{
+		StackName:      stackName,
+		Template:       []byte(integrationTemplate),
+		Parameters:     map[string]string{"Value": "two"},
+		CloudFormation: svc,
+		Yes:            true,
+		PollInterval:   time.Second,
+		Stdout:         io.Discard,
+		Logger:         log.New(io.Discard, "", 0),
+	}
+}
+
+func stackParameter(t *testing.T, svc *cloudformation.Client, stackName, key string) string {
+	t.Helper()
+	stack, err := DescribeStack(t.Context(), svc, stackName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range stack.Parameters {
+		if unptr(p.ParameterKey) == key {
+			return unptr(p.ParameterValue)
+		}
+	}
+	return ""
+}
+
+func TestIntegrationUpdate(t *testing.T) {
+	cfg := integrationConfig(t)
+	svc := cloudformation.NewFromConfig(cfg)
+	name := createTestStack(t, svc)
+
+	if err := Run(t.Context(), integrationOptions(svc, name)); err != nil {
+		t.Fatal(err)
+	}
+	if v := stackParameter(t, svc, name, "Value"); v != "two" {
+		t.Fatalf("parameter Value is %q after update, want two", v)
+	}
+	if err := Run(t.Context(), integrationOptions(svc, name)); !errors.Is(err, ErrNoChanges) {
+		t.Fatalf("second run with the same parameters: got %v, want ErrNoChanges", err)
+	}
+}
+
+func TestIntegrationUpload(t *testing.T) {
+	cfg := integrationConfig(t)
+	svc := cloudformation.NewFromConfig(cfg)
+	name := createTestStack(t, svc)
+
+	opts := integrationOptions(svc, name)
+	// a template over the inline size limit, so that it has to be uploaded
+	opts.Template = fmt.Appendf(nil, "%sMetadata:\n  Padding: %q\n", integrationTemplate, strings.Repeat("x", 60<<10))
+	opts.S3 = s3.NewFromConfig(cfg, func(o *s3.Options) { o.UsePathStyle = true })
+	opts.CreateBucket = true
+	if err := Run(t.Context(), opts); err != nil {
+		t.Fatal(err)
+	}
+	if v := stackParameter(t, svc, name, "Value"); v != "two" {
+		t.Fatalf("parameter Value is %q after update, want two", v)
+	}
+}
@@ -0,0 +1,109 @@
+package stackupdate
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation/types"
+)
+
+// resourceFailure is a stack event reporting a resource operation failure.
+type resourceFailure struct {
+	status types.ResourceStatus
+	reason string
+}
+
+// recordFailures adds the first failure of each resource found in evs to m.
+func recordFailures(m map[string]resourceFailure, evs []types.StackEvent) {
+	for _, e := range evs {
+		id := unptr(e.LogicalResourceId)
+		if _, ok := m[id]; ok || !strings.HasSuffix(string(e.ResourceStatus), "_FAILED") {
+			continue
+		}
+		m[id] = resourceFailure{status: e.ResourceStatus, reason: unptr(e.ResourceStatusReason)}
+	}
+}
+
+type junitTestSuite struct {
+	XMLName  xml.Name        `xml:"testsuite"`
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Skipped  int             `xml:"skipped,attr"`
+	Time     float64         `xml:"time,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	ClassName string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr,omitempty"`
+	Text    string `xml:",chardata"`
+}
+
+// writeJUnit saves a JUnit XML report of the run to file name: a test case
+// per resource change, failed if the resource failed to update, skipped if
+// the change set was not executed, and a test case for the update as a
+// whole, failed if the run failed.
+func writeJUnit(name string, s *runSummary, err error, dryRun bool, elapsed time.Duration) error {
+	suite := junitTestSuite{
+		Name: "stack-update " + s.StackName,
+		Time: elapsed.Round(time.Millisecond).Seconds(),
+	}
+	var skipReason string
+	switch {
+	case dryRun:
+		skipReason = "dry run"
+	case s.Status != "updated" && len(s.failures) == 0:
+		skipReason = "change set was not executed"
+	}
+	for _, c := range s.changes {
+		rc := c.ResourceChange
+		if rc == nil {
+			continue
+		}
+		tc := junitTestCase{
+			ClassName: unptr(rc.ResourceType),
+			Name:      fmt.Sprintf("%s (%s)", unptr(rc.LogicalResourceId), rc.Action),
+		}
+		if f, ok := s.failures[unptr(rc.LogicalResourceId)]; ok {
+			tc.Failure = &junitMessage{Message: f.reason, Type: string(f.status), Text: f.reason}
+		} else if skipReason != "" {
+			tc.Skipped = &junitMessage{Message: skipReason}
+		}
+		suite.Cases = append(suite.Cases, tc)
+	}
+	overall := junitTestCase{ClassName: "stack", Name: "update " + s.StackName}
+	switch {
+	case errors.Is(err, ErrNoChanges):
+	case err != nil:
+		overall.Failure = &junitMessage{Message: err.Error(), Text: err.Error()}
+	case dryRun:
+		overall.Skipped = &junitMessage{Message: skipReason}
+	}
+	suite.Cases = append(suite.Cases, overall)
+	for _, tc := range suite.Cases {
+		suite.Tests++
+		if tc.Failure != nil {
+			suite.Failures++
+		}
+		if tc.Skipped != nil {
+			suite.Skipped++
+		}
+	}
+	b, err := xml.MarshalIndent(suite, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name, append([]byte(xml.Header), append(b, '\n')...), 0666)
+}
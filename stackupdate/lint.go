@@ -0,0 +1,95 @@
+package stackupdate
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// lintResourceTypes lists resource types worth a warning. Entries ending
+// with "::" match all types with this prefix.
+var lintResourceTypes = []struct {
+	typ, message string
+}{
+	{"AWS::AutoScaling::LaunchConfiguration", "launch configurations are deprecated, use AWS::EC2::LaunchTemplate"},
+	{"AWS::ElasticLoadBalancing::LoadBalancer", "Classic Load Balancer is a previous generation load balancer, consider AWS::ElasticLoadBalancingV2::LoadBalancer"},
+	{"AWS::SDB::Domain", "Amazon SimpleDB is a legacy service, consider Amazon DynamoDB"},
+	{"AWS::OpsWorks::", "AWS OpsWorks has reached end of life"},
+	{"AWS::CodeStar::", "AWS CodeStar has been discontinued"},
+	{"AWS::RoboMaker::", "AWS RoboMaker has reached end of support"},
+	{"AWS::Cloud9::", "AWS Cloud9 is no longer available to new customers"},
+}
+
+// lint returns warnings about the template: about its parameters, sorted by
+// name, then about its resources, sorted by logical id.
+func (t *parsedTemplate) lint() []string {
+	var out []string
+	for _, name := range slices.Sorted(maps.Keys(t.Parameters)) {
+		for _, s := range t.Parameters[name].lint() {
+			out = append(out, fmt.Sprintf("parameter %s: %s", name, s))
+		}
+	}
+	for _, id := range slices.Sorted(maps.Keys(t.Resources)) {
+		typ := t.Resources[id].Type
+		for _, l := range lintResourceTypes {
+			if typ == l.typ || strings.HasSuffix(l.typ, "::") && strings.HasPrefix(typ, l.typ) {
+				out = append(out, fmt.Sprintf("resource %s (%s): %s", id, typ, l.message))
+				break
+			}
+		}
+	}
+	return out
+}
+
+// lint returns problems with the parameter declaration: unknown type,
+// constraints that don't apply to its type or contradict each other, and a
+// default value violating its constraints.
+func (p templateParameter) lint() []string {
+	var out []string
+	switch typ := p.Type; {
+	case typ == "":
+		out = append(out, "no Type")
+	case typ == "String", typ == "Number", typ == "List<Number>", typ == "CommaDelimitedList":
+	case strings.HasPrefix(typ, "AWS::"), strings.HasPrefix(typ, "List<AWS::"):
+	default:
+		out = append(out, fmt.Sprintf("unsupported Type %q", typ))
+	}
+	for _, c := range []struct {
+		name, min, max, typ string
+		parse               func(string) error
+	}{
+		{"Length", p.MinLength, p.MaxLength, "String", func(s string) error { _, err := strconv.Atoi(s); return err }},
+		{"Value", p.MinValue, p.MaxValue, "Number", func(s string) error { _, err := strconv.ParseFloat(s, 64); return err }},
+	} {
+		if c.min == "" && c.max == "" {
+			continue
+		}
+		if p.Type != c.typ {
+			out = append(out, fmt.Sprintf("Min%s and Max%s only apply to %s parameters, not to %s", c.name, c.name, c.typ, p.Type))
+			continue
+		}
+		var invalid bool
+		for _, v := range []struct{ name, value string }{{"Min" + c.name, c.min}, {"Max" + c.name, c.max}} {
+			if v.value != "" && c.parse(v.value) != nil {
+				out = append(out, fmt.Sprintf("%s %q is not a number", v.name, v.value))
+				invalid = true
+			}
+		}
+		if invalid || c.min == "" || c.max == "" {
+			continue
+		}
+		lo, _ := strconv.ParseFloat(c.min, 64)
+		hi, _ := strconv.ParseFloat(c.max, 64)
+		if lo > hi {
+			out = append(out, fmt.Sprintf("Min%s %s is greater than Max%s %s", c.name, c.min, c.name, c.max))
+		}
+	}
+	if p.Default != nil && p.Type != "" {
+		if err := p.validate(*p.Default); err != nil {
+			out = append(out, fmt.Sprintf("Default does not satisfy parameter constraints: %v", err))
+		}
+	}
+	return out
+}
@@ -0,0 +1,193 @@
+package stackupdate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation/types"
+)
+
+// DiffParameters writes opts.Parameters whose values differ from current
+// parameters of opts.StackName to opts.Stdout, either as a table, or as
+// JSON if asJSON is set, without creating a change set. Parameters not in
+// opts.Parameters are not compared. Values of parameters with names matching
+// opts.Redact are compared, but shown as "****". CloudFormation does not
+// return values of NoEcho parameters, so those are listed as not compared;
+// parameters are also treated as NoEcho if opts.Template declares them so.
+//
+// DiffParameters returns ErrNoChanges if there are no differences. It only
+// uses the following fields of opts: CloudFormation, StackName, Parameters,
+// Template, Redact, and Stdout.
+func DiffParameters(ctx context.Context, opts Options, asJSON bool) error {
+	if opts.StackName == "" {
+		return errors.New("empty stack name")
+	}
+	if opts.CloudFormation == nil {
+		return errors.New("nil CloudFormation client")
+	}
+	if opts.Stdout == nil {
+		opts.Stdout = os.Stdout
+	}
+	var tpl *parsedTemplate
+	if len(opts.Template) != 0 {
+		var err error
+		if tpl, err = parseTemplate(opts.Template); err != nil {
+			return fmt.Errorf("parsing template: %w", err)
+		}
+	}
+	stack, err := DescribeStack(ctx, opts.CloudFormation, opts.StackName)
+	if err != nil {
+		return err
+	}
+	current := make(map[string]string, len(stack.Parameters))
+	for _, p := range stack.Parameters {
+		current[unptr(p.ParameterKey)] = unptr(p.ParameterValue)
+	}
+	type difference struct {
+		Key string `json:"key"`
+		Old string `json:"old,omitempty"`
+		New string `json:"new"`
+		Set bool   `json:"set"` // whether stack has this parameter
+	}
+	diffs := []difference{}
+	notCompared := []string{}
+	for _, k := range slices.Sorted(maps.Keys(opts.Parameters)) {
+		v := opts.Parameters[k]
+		old, ok := current[k]
+		if old == noEchoValue || tpl != nil && tpl.Parameters[k].noEcho() {
+			notCompared = append(notCompared, k)
+			continue
+		}
+		if ok && old == v {
+			continue
+		}
+		diffs = append(diffs, difference{
+			Key: k,
+			Old: redact(opts.Redact, k, old),
+			New: redact(opts.Redact, k, v),
+			Set: ok,
+		})
+	}
+	if asJSON {
+		enc := json.NewEncoder(opts.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(struct {
+			Differences []difference `json:"differences"`
+			NotCompared []string     `json:"notCompared"`
+		}{diffs, notCompared}); err != nil {
+			return err
+		}
+	} else if len(diffs) != 0 {
+		tw := tabwriter.NewWriter(opts.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "Parameter\tCurrent\tNew\t")
+		for _, d := range diffs {
+			old := d.Old
+			if !d.Set {
+				old = "(not set)"
+			}
+			fmt.Fprintf(tw, "%v\t%v\t%v\t\n", d.Key, old, d.New)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+	if !asJSON && len(notCompared) != 0 {
+		fmt.Fprintf(opts.Stdout, "NoEcho parameters, not compared: %s\n", strings.Join(notCompared, ", "))
+	}
+	if len(diffs) == 0 {
+		return ErrNoChanges
+	}
+	return nil
+}
+
+// noEchoValue is what CloudFormation returns in place of NoEcho parameter
+// values.
+const noEchoValue = "****"
+
+// writeParameterChanges renders parameters whose values params change as
+// "key: old → new" lines, old values in red and new ones in green. If tpl is
+// set, current stack parameters not in params are shown as changed to the
+// template default, if tpl declares one, or as removed.
+// Values of NoEcho parameters, which are either returned by CloudFormation
+// as "****", or declared as NoEcho in tpl, and of parameters with names
+// matching redactRe are shown as "****". Nothing is written if there are no
+// changes.
+func writeParameterChanges(w io.Writer, current []types.Parameter, params []types.Parameter, tpl *parsedTemplate, redactRe *regexp.Regexp) {
+	var declared map[string]templateParameter
+	if tpl != nil {
+		declared = tpl.Parameters
+	}
+	old := make(map[string]string, len(current))
+	for _, p := range current {
+		old[unptr(p.ParameterKey)] = unptr(p.ParameterValue)
+	}
+	hide := func(k, v string) string {
+		if declared[k].noEcho() {
+			return redactedValue
+		}
+		return redact(redactRe, k, v)
+	}
+	type change struct{ key, old, new string }
+	var changes []change
+	passed := make(map[string]bool, len(params))
+	for _, p := range params {
+		k := unptr(p.ParameterKey)
+		passed[k] = true
+		if unptr(p.UsePreviousValue) {
+			continue
+		}
+		v := unptr(p.ParameterValue)
+		prev, ok := old[k]
+		switch {
+		case !ok:
+			changes = append(changes, change{k, "(not set)", hide(k, v)})
+		case prev == noEchoValue || declared[k].noEcho():
+			// value is unknown, so it may or may not change
+			changes = append(changes, change{k, noEchoValue, redactedValue + " (NoEcho, may be unchanged)"})
+		case prev != v:
+			changes = append(changes, change{k, hide(k, prev), hide(k, v)})
+		}
+	}
+	for _, p := range current {
+		k := unptr(p.ParameterKey)
+		if passed[k] || tpl == nil {
+			continue
+		}
+		if d := declared[k].Default; d != nil {
+			if unptr(p.ParameterValue) != *d {
+				changes = append(changes, change{k, hide(k, unptr(p.ParameterValue)), hide(k, *d) + " (template default)"})
+			}
+			continue
+		}
+		changes = append(changes, change{k, hide(k, unptr(p.ParameterValue)), "(removed)"})
+	}
+	if len(changes) == 0 {
+		return
+	}
+	slices.SortFunc(changes, func(a, b change) int { return strings.Compare(a.key, b.key) })
+	fmt.Fprintln(w, "\nParameter changes:")
+	for _, c := range changes {
+		fmt.Fprintf(w, "  %s: \033[31m%s\033[0m → \033[32m%s\033[0m\n", c.key, c.old, c.new)
+	}
+}
+
+// noColorWriter removes ANSI escape sequences from text written to w.
+type noColorWriter struct{ w io.Writer }
+
+var ansiEscape = regexp.MustCompile("\033\\[[0-9;]*m")
+
+func (w noColorWriter) Write(p []byte) (int, error) {
+	if _, err := w.w.Write(ansiEscape.ReplaceAll(p, nil)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,35 @@
+package stackupdate
+
+import "time"
+
+// Names of the phases of Run reported to Options.OnPhase.
+const (
+	PhaseCreateChangeSet  = "create-change-set"
+	PhaseWaitChangeSet    = "wait-change-set"
+	PhaseExecuteChangeSet = "execute-change-set"
+	PhaseWaitUpdate       = "wait-update"
+)
+
+// phases tracks the current phase of Run to report it to Options.OnPhase
+// once it ends.
+type phases struct {
+	fn          func(name string, start time.Time, changeSetID string, err error)
+	name        string
+	start       time.Time
+	changeSetID string
+}
+
+// begin ends the current phase, if any, and starts a new one.
+func (p *phases) begin(name string) {
+	p.end(nil)
+	p.name, p.start = name, time.Now()
+}
+
+// end reports the current phase, if any, as ended with err.
+func (p *phases) end(err error) {
+	if p.fn == nil || p.name == "" {
+		return
+	}
+	p.fn(p.name, p.start, p.changeSetID, err)
+	p.name = ""
+}
@@ -0,0 +1,67 @@
+package stackupdate
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// promptParameters asks for values of template parameters named in keys,
+// showing their descriptions and constraints, and re-asking for values
+// that don't satisfy them. If r runs out of input, it returns an error
+// listing parameters left without values.
+func promptParameters(r io.Reader, w io.Writer, tpl *parsedTemplate, keys []string) (map[string]string, error) {
+	out := make(map[string]string, len(keys))
+	for i, k := range keys {
+		p := tpl.Parameters[k]
+		fmt.Fprintf(w, "\nParameter %s (%s)", k, p.Type)
+		if p.Description != "" {
+			fmt.Fprintf(w, ": %s", p.Description)
+		}
+		fmt.Fprintln(w)
+		if len(p.AllowedValues) != 0 {
+			fmt.Fprintf(w, "Allowed values: %s\n", strings.Join(p.AllowedValues, ", "))
+		}
+		for {
+			fmt.Fprintf(w, "%s: ", k)
+			v, err := readLine(r)
+			if err != nil {
+				if errors.Is(err, io.EOF) {
+					return nil, fmt.Errorf("template parameters have no values: %s", strings.Join(keys[i:], ", "))
+				}
+				return nil, err
+			}
+			if err := p.validate(v); err != nil {
+				fmt.Fprintln(w, err)
+				continue
+			}
+			out[k] = v
+			break
+		}
+	}
+	return out, nil
+}
+
+// readLine reads a single line from r, without the line end. It reads r one
+// byte at a time, so that input following the line is left in r.
+func readLine(r io.Reader) (string, error) {
+	var sb strings.Builder
+	var b [1]byte
+	for {
+		n, err := r.Read(b[:])
+		if n == 1 {
+			if b[0] == '\n' {
+				return strings.TrimSuffix(sb.String(), "\r"), nil
+			}
+			if sb.Len() > 4096 {
+				return "", errors.New("input line is too long")
+			}
+			sb.WriteByte(b[0])
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+}
@@ -0,0 +1,17 @@
+package stackupdate
+
+import "regexp"
+
+// DefaultRedactPattern matches names of parameters that likely hold secrets.
+const DefaultRedactPattern = `(?i)passw(or)?d|secret|token|api_?key|private_?key|credential`
+
+// redactedValue is shown in place of redacted parameter values.
+const redactedValue = "****"
+
+// redact returns value, or redactedValue if re matches parameter name key.
+func redact(re *regexp.Regexp, key, value string) string {
+	if re != nil && value != "" && re.MatchString(key) {
+		return redactedValue
+	}
+	return value
+}
@@ -0,0 +1,67 @@
+package stackupdate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation"
+)
+
+// ListStackResources writes current stack resources to w, either as a
+// table, or as JSON if asJSON is set.
+func ListStackResources(ctx context.Context, svc cloudformation.ListStackResourcesAPIClient, stackName string, w io.Writer, asJSON bool) error {
+	type resource struct {
+		LogicalResourceID  string    `json:"logicalResourceId"`
+		PhysicalResourceID string    `json:"physicalResourceId,omitempty"`
+		ResourceType       string    `json:"resourceType"`
+		Status             string    `json:"status"`
+		StatusReason       string    `json:"statusReason,omitempty"`
+		DriftStatus        string    `json:"driftStatus,omitempty"`
+		LastUpdated        time.Time `json:"lastUpdated"`
+	}
+	resources := []resource{}
+	p := cloudformation.NewListStackResourcesPaginator(svc, &cloudformation.ListStackResourcesInput{StackName: &stackName})
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, r := range page.StackResourceSummaries {
+			res := resource{
+				LogicalResourceID:  unptr(r.LogicalResourceId),
+				PhysicalResourceID: unptr(r.PhysicalResourceId),
+				ResourceType:       unptr(r.ResourceType),
+				Status:             string(r.ResourceStatus),
+				StatusReason:       unptr(r.ResourceStatusReason),
+				LastUpdated:        unptr(r.LastUpdatedTimestamp),
+			}
+			if d := r.DriftInformation; d != nil {
+				res.DriftStatus = string(d.StackResourceDriftStatus)
+			}
+			resources = append(resources, res)
+		}
+	}
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(resources)
+	}
+	if len(resources) == 0 {
+		_, err := fmt.Fprintf(w, "stack %s has no resources\n", stackName)
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "LogicalId\tPhysicalId\tType\tStatus\tUpdated\t")
+	for _, r := range resources {
+		var updated string
+		if !r.LastUpdated.IsZero() {
+			updated = r.LastUpdated.Local().Format(time.DateTime)
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t\n", r.LogicalResourceID, r.PhysicalResourceID, r.ResourceType, r.Status, updated)
+	}
+	return tw.Flush()
+}
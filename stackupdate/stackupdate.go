@@ -0,0 +1,1552 @@
+// Package stackupdate updates an existing CloudFormation stack using a change
+// set: it creates the change set, shows the changes it is about to apply,
+// waits for confirmation, and then executes the change set.
+package stackupdate
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation"
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+)
+
+// CloudFormationAPI is the subset of the CloudFormation client methods used
+// by Run. It is satisfied by *cloudformation.Client.
+type CloudFormationAPI interface {
+	DescribeStacks(context.Context, *cloudformation.DescribeStacksInput, ...func(*cloudformation.Options)) (*cloudformation.DescribeStacksOutput, error)
+	CreateChangeSet(context.Context, *cloudformation.CreateChangeSetInput, ...func(*cloudformation.Options)) (*cloudformation.CreateChangeSetOutput, error)
+	DeleteChangeSet(context.Context, *cloudformation.DeleteChangeSetInput, ...func(*cloudformation.Options)) (*cloudformation.DeleteChangeSetOutput, error)
+	DescribeChangeSet(context.Context, *cloudformation.DescribeChangeSetInput, ...func(*cloudformation.Options)) (*cloudformation.DescribeChangeSetOutput, error)
+	ExecuteChangeSet(context.Context, *cloudformation.ExecuteChangeSetInput, ...func(*cloudformation.Options)) (*cloudformation.ExecuteChangeSetOutput, error)
+	DescribeEvents(context.Context, *cloudformation.DescribeEventsInput, ...func(*cloudformation.Options)) (*cloudformation.DescribeEventsOutput, error)
+	SetStackPolicy(context.Context, *cloudformation.SetStackPolicyInput, ...func(*cloudformation.Options)) (*cloudformation.SetStackPolicyOutput, error)
+	CancelUpdateStack(context.Context, *cloudformation.CancelUpdateStackInput, ...func(*cloudformation.Options)) (*cloudformation.CancelUpdateStackOutput, error)
+	DescribeStackEvents(context.Context, *cloudformation.DescribeStackEventsInput, ...func(*cloudformation.Options)) (*cloudformation.DescribeStackEventsOutput, error)
+	GetTemplate(context.Context, *cloudformation.GetTemplateInput, ...func(*cloudformation.Options)) (*cloudformation.GetTemplateOutput, error)
+	UpdateTerminationProtection(context.Context, *cloudformation.UpdateTerminationProtectionInput, ...func(*cloudformation.Options)) (*cloudformation.UpdateTerminationProtectionOutput, error)
+}
+
+// S3API is the subset of the S3 client methods used by Run to upload
+// templates too big to be provided inline. It is satisfied by *s3.Client.
+type S3API interface {
+	ListBuckets(context.Context, *s3.ListBucketsInput, ...func(*s3.Options)) (*s3.ListBucketsOutput, error)
+	GetBucketTagging(context.Context, *s3.GetBucketTaggingInput, ...func(*s3.Options)) (*s3.GetBucketTaggingOutput, error)
+	GetBucketEncryption(context.Context, *s3.GetBucketEncryptionInput, ...func(*s3.Options)) (*s3.GetBucketEncryptionOutput, error)
+	PutObject(context.Context, *s3.PutObjectInput, ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	CreateBucket(context.Context, *s3.CreateBucketInput, ...func(*s3.Options)) (*s3.CreateBucketOutput, error)
+}
+
+// ErrNoChanges is returned by Run when the change set has nothing to update.
+var ErrNoChanges = errors.New("no changes")
+
+// Errors returned by Run wrap these to tell kinds of failures apart; use
+// errors.Is to check for them.
+var (
+	ErrStackNotFound      = errors.New("stack not found")
+	ErrAccessDenied       = errors.New("access denied")
+	ErrTimeout            = errors.New("timed out")                          // ctx deadline expired, or stack was not ready within Options.WaitReady
+	ErrManagedStack       = errors.New("stack is managed")                   // stack is nested or a StackSet instance, and Options.AllowManaged is not set
+	ErrIAMChanges         = errors.New("change set has IAM changes")         // with Options.FailOnIAMChanges
+	ErrDestructiveChanges = errors.New("change set has destructive changes") // with Options.FailOnDestructive
+)
+
+// InsufficientCapabilitiesError is returned by Run when the change set
+// requires capabilities that were not acknowledged, and
+// Options.AutoCapabilities is not set.
+type InsufficientCapabilitiesError struct {
+	Missing []types.Capability
+	Err     error
+}
+
+func (e *InsufficientCapabilitiesError) Error() string {
+	return fmt.Sprintf("change set requires capabilities %s: %v", joinCapabilities(e.Missing), e.Err)
+}
+
+func (e *InsufficientCapabilitiesError) Unwrap() error { return e.Err }
+
+// DefaultDescription is a change set description used if
+// Options.Description is empty.
+const DefaultDescription = "created using stack-update tool"
+
+// Options configure a stack update done by Run.
+type Options struct {
+	StackName  string            // name of an existing stack to update
+	Template   []byte            // template body
+	Parameters map[string]string // parameter overrides; other stack parameters keep their previous values
+	Tags       map[string]string // tags to set on the stack, merged over its existing tags
+	// ParameterStrategy defines how stack parameters not in Parameters are
+	// handled:
+	//
+	//   - "merge" (or empty) keeps their previous values;
+	//   - "replace" omits them, so that only Parameters are passed;
+	//     template parameters without a default value must all be in
+	//     Parameters;
+	//   - "reset" makes those with a default value in the template use it,
+	//     and others keep previous values.
+	ParameterStrategy string
+	// Description of the change set, up to 1024 characters; if empty,
+	// DefaultDescription is used.
+	Description string
+	// StackPolicy, if set, is a stack policy document (JSON) to set on the
+	// stack before executing the change set.
+	StackPolicy []byte
+
+	// Capabilities to acknowledge in addition to those the stack already
+	// has.
+	Capabilities []types.Capability
+	// AutoCapabilities makes Run acknowledge capabilities that the template
+	// likely needs (CAPABILITY_IAM and CAPABILITY_NAMED_IAM, if it has
+	// IAM resources), and those CloudFormation reports as required.
+	AutoCapabilities bool
+
+	// TerminationProtection, if set, is the termination protection setting
+	// applied to the stack once the change set is executed and the update
+	// completes. It is not applied if the change set is not executed, e.g.
+	// with DryRun, or if the update fails.
+	TerminationProtection *bool
+
+	// AllowManaged makes Run update stacks managed by a parent stack or a
+	// StackSet, which it otherwise refuses to.
+	AllowManaged bool
+
+	// ExecuteDelay, if positive, is how long Run waits after confirmation
+	// (or without it, with Yes) before executing the change set, showing a
+	// countdown, so that the update can still be aborted by canceling ctx.
+	ExecuteDelay time.Duration
+
+	// BeforeExecute, if set, is called right before the change set is
+	// executed, after ExecuteDelay passes. If it returns an error, the
+	// change set is not executed, and Run fails with this error.
+	BeforeExecute func(ctx context.Context, stackID, changeSetID string) error
+	// AfterExecute, if set, is called once BeforeExecute succeeds, or is
+	// not set, when the update ends, whatever its outcome: err is nil if
+	// the update completed, or the error Run is about to return. The ctx
+	// it is called with is not canceled when Run's ctx is.
+	AfterExecute func(ctx context.Context, stackID, changeSetID string, err error)
+
+	// YesOnEOF makes Run execute the change set if Stdin is closed
+	// without an answer to the confirmation prompt. Otherwise such a run
+	// is aborted, same as if the answer was no.
+	YesOnEOF bool
+
+	// PromptParameters makes Run ask for values of template parameters that
+	// have no default value, and no value either in Parameters or on the
+	// stack, reading answers from Stdin. With Yes, without Interactive, or
+	// if Stdin runs out of input, Run returns an error listing such
+	// parameters instead.
+	PromptParameters bool
+	// Interactive tells Run that Stdin is a terminal, so that it can ask
+	// for parameter values, see PromptParameters.
+	Interactive bool
+
+	// ValidateParameters makes Run check Parameters against types and
+	// constraints declared in the template before creating a change set,
+	// and fail if the template does not declare some of them (Run only
+	// warns about such parameters otherwise).
+	ValidateParameters bool
+	// OutputTemplate, if set, is a file to save the processed template of
+	// the change set to, with transforms (like SAM) expanded.
+	OutputTemplate string
+	// OutputTemplateStage is the stage of the template saved to
+	// OutputTemplate: Processed (default), or Original, as submitted,
+	// before transforms are applied.
+	OutputTemplateStage types.TemplateStage
+	// CSVOut, if set, is a file to save resource changes of the change
+	// set to as CSV once it's ready, with the same columns as the changes
+	// table. All changes are saved, regardless of Filter.
+	CSVOut string
+	// Lint makes Run log warnings about template issues, like use of
+	// deprecated resource types, or parameter declarations with unknown
+	// types, or defaults violating their constraints.
+	Lint bool
+
+	// TemplateFormat is either "json" or "yaml"; if empty, it's detected
+	// from the template body.
+	TemplateFormat string
+
+	Events           bool      // print stack events while waiting for update to complete
+	TailLines        int       // with Events, print at most this many latest events per poll; 0 means unlimited
+	EventsOnFailure  bool      // if Events is not set, print stack events only once the update fails
+	Progress         bool      // log how many of changed resources completed their update while waiting for it
+	EventsSince      time.Time // with Events, if set, print events newer than this, not only those after execution start
+	NoExecuteIfEmpty bool      // return ErrNoChanges without prompting if change set has no resource changes
+
+	// FailOnIAMChanges makes Run fail after showing the changes if any of
+	// them affect IAM: changes of AWS::IAM::* and AWS::SSO::* resources, of
+	// resources holding resource-based policies, like
+	// AWS::S3::BucketPolicy or AWS::KMS::Key, or of policy document
+	// properties of other resources, like PolicyDocument or KeyPolicy.
+	FailOnIAMChanges bool
+	// FailOnDestructive makes Run fail after showing the changes if any of
+	// them remove or replace resources, including conditional
+	// replacements.
+	FailOnDestructive bool
+
+	// DryRun makes Run only show the changes, then delete the change set
+	// without executing it. Run returns ErrNoChanges if there are none.
+	DryRun bool
+	// Yes makes Run execute the change set without asking for confirmation.
+	Yes bool
+	// PromptTimeout, if positive, is how long to wait for an answer to
+	// confirmation prompt; no answer within it aborts the update.
+	PromptTimeout time.Duration
+
+	CloudFormation CloudFormationAPI
+	S3             S3API // only used if template is too big to be provided inline
+
+	// NoUpload makes Run fail instead of uploading templates too big to be
+	// provided inline to S3.
+	NoUpload bool
+	// ForceUpload makes Run upload template to S3 even if it's small enough
+	// to be provided inline.
+	ForceUpload bool
+	// TemplateKeyPrefix is prepended to S3 keys of uploaded templates,
+	// which are stack-name/sha256-of-template by default.
+	TemplateKeyPrefix string
+	// TemplateKeyDate adds a date (YYYY-MM-DD, UTC) between the stack
+	// name and the hash in S3 keys of uploaded templates.
+	TemplateKeyDate bool
+	// TemplateACL, if set, is the canned ACL, like
+	// bucket-owner-full-control, to set on uploaded templates. It's needed
+	// when the bucket belongs to another account and doesn't enforce bucket
+	// owner object ownership, so that the bucket owner could read templates.
+	TemplateACL string
+	// CreateBucket makes Run create a cf-templates-*-region bucket if
+	// there is none to upload template to. It has no effect if
+	// TemplateBucketTagKey is set.
+	CreateBucket bool
+	// TemplateBucketTagKey and TemplateBucketTagValue, if set, select the
+	// bucket to upload templates to by its tag, instead of looking for the
+	// cf-templates-*-region bucket CloudFormation console creates.
+	TemplateBucketTagKey   string
+	TemplateBucketTagValue string
+
+	// SummaryOut, if set, is a local file to save a JSON summary of the run
+	// to, whatever its outcome, including dry runs. Failure to save it
+	// does not change the result of Run.
+	SummaryOut string
+	// JUnitOut, if set, is a local file to save a JUnit XML report of the
+	// run to, for CI test reporting: each resource change is a test case,
+	// failed if the resource failed to update. Failure to save it does not
+	// change the result of Run.
+	JUnitOut string
+
+	// HistoryDir, if set, is a local directory where Run keeps a history
+	// of change sets it executed, in a JSON file per stack name, see
+	// History. Failure to save it does not change the result of Run.
+	HistoryDir string
+
+	// AuditOut, if set, is where to save a JSON record of the executed
+	// change set: either a local file path, or an s3://bucket/key url.
+	// Failure to save it does not stop the update.
+	AuditOut string
+	Caller   string // identity of the caller (e.g. IAM ARN) recorded in the audit record
+
+	// Redact, if set, matches names of parameters whose values are replaced
+	// with **** in audit records, run summaries, and validation errors,
+	// e.g. DefaultRedactPattern.
+	Redact *regexp.Regexp
+
+	// CreateTimeout and ExecuteTimeout, if positive, limit how long Run
+	// waits for the change set to be created, and for the update to
+	// complete; ctx deadline, if any, still applies.
+	CreateTimeout  time.Duration
+	ExecuteTimeout time.Duration
+
+	// RollbackOnTimeout makes Run cancel the stack update if ctx deadline
+	// (or ExecuteTimeout) expires while waiting for update to complete. Canceling an update
+	// rolls the stack back, which takes time on its own.
+	RollbackOnTimeout bool
+
+	// WaitReady, if positive, is how long to wait for the stack to finish
+	// its in-progress operation before creating a change set. If zero, Run
+	// does not wait, and fails if the stack is not ready for update.
+	WaitReady time.Duration
+
+	// PollInterval is how often change set status is checked while waiting
+	// for it to be created or executed; 3 seconds if zero.
+	PollInterval time.Duration
+
+	// CreateRetries is how many times to retry creating a change set if
+	// CloudFormation rejects it because the stack has an operation in
+	// progress. Retries are done with exponential backoff starting at 5
+	// seconds.
+	CreateRetries int
+
+	// CleanupTimeout limits how long Run waits for the change set to be
+	// deleted when it's not executed; 10 seconds if zero.
+	CleanupTimeout time.Duration
+
+	// RefreshCredentials, if set, is called to discard cached credentials
+	// when AWS rejects them as expired while Run waits for the change set.
+	RefreshCredentials func()
+
+	// OpenConsole, if set, is called with the stack id once change set
+	// execution starts.
+	OpenConsole func(stackID string) error
+	// OnPhase, if set, is called when each of the major phases of the
+	// update ends (see Phase* constants), with the phase start time, change
+	// set id, if it's known, and the error the phase failed with, if any.
+	// It's meant for reporting durations of these phases, e.g. as tracing
+	// spans. Runs that end with ErrNoChanges report it as an error of the
+	// last phase.
+	OnPhase func(name string, start time.Time, changeSetID string, err error)
+	// ConsoleDomain, if set, is the AWS console domain used in links to
+	// the change set, for partitions where it can't be derived from the
+	// stack ARN; see StackURL.
+	ConsoleDomain string
+
+	// GroupBy, if set to "type", makes Run show changes grouped by
+	// resource type.
+	GroupBy string
+	// Filter hides some of the changes shown; the change set is still
+	// executed in full.
+	Filter ChangeFilter
+	// Format of the changes: "table" (default), or "diff" for one line per
+	// change with a diff-like marker: + add, ~ modify, - remove, -/+ replace.
+	Format string
+	// NoColor makes Run print no ANSI escape sequences, like colors or
+	// bold text.
+	NoColor bool
+
+	Verbose bool // log additional details
+
+	Stdin  io.Reader   // source of confirmation prompt and parameter answers; os.Stdin if nil
+	Stdout io.Writer   // destination of change set table and prompt; os.Stdout if nil
+	Logger *log.Logger // destination of progress messages; log.Default() if nil
+
+	ChangesOut io.Writer // if set, also receives a copy of the change set table
+}
+
+// Run updates the stack as configured by opts. It returns nil once the change
+// set has been executed and the update completed.
+func Run(ctx context.Context, opts Options) error {
+	begin := time.Now()
+	sum := &runSummary{StackName: opts.StackName}
+	if opts.JUnitOut != "" {
+		sum.failures = make(map[string]resourceFailure)
+	}
+	ph := &phases{fn: opts.OnPhase}
+	err := classifyError(run(ctx, opts, sum, ph))
+	ph.end(err)
+	logger := opts.Logger
+	if logger == nil {
+		logger = log.Default()
+	}
+	if opts.SummaryOut != "" {
+		sum.finish(err, opts.DryRun, time.Since(begin))
+		if err := writeSummary(opts.SummaryOut, sum); err != nil {
+			logger.Printf("WARNING: failed to write run summary to %s: %v", opts.SummaryOut, err)
+		}
+	}
+	if opts.JUnitOut != "" {
+		sum.finish(err, opts.DryRun, time.Since(begin))
+		if err := writeJUnit(opts.JUnitOut, sum, err, opts.DryRun, time.Since(begin)); err != nil {
+			logger.Printf("WARNING: failed to write JUnit report to %s: %v", opts.JUnitOut, err)
+		}
+	}
+	if opts.HistoryDir != "" && err == nil && !opts.DryRun {
+		if err := appendHistory(opts.HistoryDir, sum); err != nil {
+			logger.Printf("WARNING: failed to save stack history to %s: %v", opts.HistoryDir, err)
+		}
+	}
+	return err
+}
+
+// classifyError wraps err with ErrAccessDenied or ErrTimeout, if it is an
+// AWS access denied error or a context deadline error.
+func classifyError(err error) error {
+	if err == nil || errors.Is(err, ErrAccessDenied) || errors.Is(err, ErrTimeout) {
+		return err
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %w", ErrTimeout, err)
+	}
+	if e, ok := errors.AsType[smithy.APIError](err); ok {
+		switch e.ErrorCode() {
+		case "AccessDenied", "AccessDeniedException", "UnauthorizedOperation":
+			return fmt.Errorf("%w: %w", ErrAccessDenied, err)
+		}
+	}
+	return err
+}
+
+// run does the work of Run, recording details of it to sum, and its phases
+// to ph.
+func run(ctx context.Context, opts Options, sum *runSummary, ph *phases) (err error) {
+	if opts.StackName == "" {
+		return errors.New("empty stack name")
+	}
+	if len(opts.Template) > 1<<20 {
+		return errors.New("template is too big")
+	}
+	format := opts.TemplateFormat
+	switch format {
+	case "json", "yaml":
+	case "":
+		format = templateFormat(opts.Template)
+	default:
+		return fmt.Errorf("unsupported template format %q, want json or yaml", format)
+	}
+	if opts.Description == "" {
+		opts.Description = DefaultDescription
+	}
+	if n := utf8.RuneCountInString(opts.Description); n > 1024 {
+		return fmt.Errorf("change set description is too long: %d characters, max is 1024", n)
+	}
+	switch opts.ParameterStrategy {
+	case "", "merge", "replace", "reset":
+	default:
+		return fmt.Errorf("unsupported parameter strategy %q, want merge, replace, or reset", opts.ParameterStrategy)
+	}
+	switch opts.Format {
+	case "", "table", "diff":
+	default:
+		return fmt.Errorf("unsupported Format value %q, want table or diff", opts.Format)
+	}
+	if err := opts.Filter.validate(); err != nil {
+		return err
+	}
+	switch opts.GroupBy {
+	case "", "type":
+	default:
+		return fmt.Errorf("unsupported GroupBy value %q, want empty or type", opts.GroupBy)
+	}
+	if opts.NoUpload && opts.ForceUpload {
+		return errors.New("NoUpload and ForceUpload are mutually exclusive")
+	}
+	if opts.CloudFormation == nil {
+		return errors.New("nil CloudFormation client")
+	}
+	if opts.Stdin == nil {
+		opts.Stdin = os.Stdin
+	}
+	if opts.Stdout == nil {
+		opts.Stdout = os.Stdout
+	}
+	if opts.NoColor {
+		opts.Stdout = noColorWriter{opts.Stdout}
+	}
+	if opts.Logger == nil {
+		opts.Logger = log.Default()
+	}
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = 3 * time.Second
+	}
+	if opts.CleanupTimeout <= 0 {
+		opts.CleanupTimeout = 10 * time.Second
+	}
+	svc := opts.CloudFormation
+	stackName := opts.StackName
+	template := opts.Template
+	overrides := maps.Clone(opts.Parameters)
+	if overrides == nil {
+		overrides = make(map[string]string) // prompted values are added to it
+	}
+	logger := opts.Logger
+
+	if opts.Lint {
+		tpl, err := parseTemplate(template)
+		if err != nil {
+			return fmt.Errorf("parsing template to lint it: %w", err)
+		}
+		for _, s := range tpl.lint() {
+			logger.Print("WARNING: ", s)
+		}
+	}
+	if opts.ValidateParameters {
+		tpl, err := parseTemplate(template)
+		if err != nil {
+			return fmt.Errorf("parsing template to validate parameters: %w", err)
+		}
+		if keys := tpl.undeclared(opts.Parameters); len(keys) != 0 {
+			return fmt.Errorf("template does not declare parameters: %s", strings.Join(keys, ", "))
+		}
+		if err := tpl.validateParameters(opts.Parameters, opts.Redact); err != nil {
+			return err
+		}
+	} else if tpl, err := parseTemplate(template); err == nil {
+		if keys := tpl.undeclared(opts.Parameters); len(keys) != 0 {
+			logger.Printf("WARNING: template does not declare parameters, CloudFormation will reject them: %s", strings.Join(keys, ", "))
+		}
+	}
+
+	stack, err := DescribeStack(ctx, svc, stackName)
+	if err != nil {
+		return err
+	}
+	sum.setStack(stack)
+	if opts.Verbose && stack.ParentId != nil {
+		logger.Printf("stack is nested: parent %s, root %s", unptr(stack.ParentId), unptr(stack.RootId))
+	}
+	if reason := managedStack(stack); reason != "" {
+		if !opts.AllowManaged {
+			return fmt.Errorf("%w: stack %s, updating it directly makes it drift from its owner", ErrManagedStack, reason)
+		}
+		logger.Printf("WARNING: stack %s, updating it directly makes it drift from its owner", reason)
+	}
+	if opts.WaitReady > 0 && strings.HasSuffix(string(stack.StackStatus), "_IN_PROGRESS") {
+		logger.Printf("stack is %v, waiting for it to finish", stack.StackStatus)
+		if stack, err = waitStackReady(ctx, svc, stackName, opts.PollInterval, opts.WaitReady); err != nil {
+			return err
+		}
+	}
+	if opts.Verbose {
+		logger.Printf("stack termination protection: %s", onOff(unptr(stack.EnableTerminationProtection)))
+	}
+	if opts.PromptParameters {
+		tpl, err := parseTemplate(template)
+		if err != nil {
+			return fmt.Errorf("parsing template to find parameters to ask for: %w", err)
+		}
+		onStack := make(map[string]bool, len(stack.Parameters))
+		if opts.ParameterStrategy != "replace" {
+			for _, p := range stack.Parameters {
+				onStack[unptr(p.ParameterKey)] = true
+			}
+		}
+		var missing []string
+		for _, k := range slices.Sorted(maps.Keys(tpl.Parameters)) {
+			if _, ok := overrides[k]; !ok && !onStack[k] && tpl.Parameters[k].Default == nil {
+				missing = append(missing, k)
+			}
+		}
+		if len(missing) != 0 && (opts.Yes || !opts.Interactive) {
+			return fmt.Errorf("template parameters have no values: %s", strings.Join(missing, ", "))
+		}
+		if len(missing) != 0 {
+			m, err := promptParameters(opts.Stdin, opts.Stdout, tpl, missing)
+			if err != nil {
+				return err
+			}
+			maps.Copy(overrides, m)
+		}
+	}
+	var declared map[string]templateParameter // template parameters, only for replace and reset strategies
+	switch opts.ParameterStrategy {
+	case "replace", "reset":
+		tpl, err := parseTemplate(template)
+		if err != nil {
+			return fmt.Errorf("parsing template to apply %s parameter strategy: %w", opts.ParameterStrategy, err)
+		}
+		declared = tpl.Parameters
+	}
+	if opts.ParameterStrategy == "replace" {
+		var missing []string
+		for k, p := range declared {
+			if _, ok := overrides[k]; !ok && p.Default == nil {
+				missing = append(missing, k)
+			}
+		}
+		if len(missing) != 0 {
+			slices.Sort(missing)
+			return fmt.Errorf("template parameters without default values must be set with replace parameter strategy: %s", strings.Join(missing, ", "))
+		}
+	}
+	params, added := stackParameters(stack.Parameters, overrides, opts.ParameterStrategy, declared)
+	if len(added) != 0 {
+		logger.Printf("stack has no parameters with these names (it's ok if your template adds them): %s", strings.Join(added, ", "))
+	}
+	if opts.Verbose {
+		if tpl, err := parseTemplate(template); err != nil {
+			logger.Printf("cannot parse template: %v", err)
+		} else {
+			var keys []string
+			for _, p := range params {
+				if k := unptr(p.ParameterKey); unptr(p.UsePreviousValue) && tpl.Parameters[k].noEcho() {
+					keys = append(keys, k)
+				}
+			}
+			if len(keys) != 0 {
+				logger.Printf("keeping previous values of NoEcho parameters, which are not shown: %s", strings.Join(keys, ", "))
+			}
+		}
+	}
+
+	var tags []types.Tag
+	if len(opts.Tags) != 0 {
+		m := make(map[string]string, len(stack.Tags)+len(opts.Tags))
+		for _, t := range stack.Tags {
+			m[unptr(t.Key)] = unptr(t.Value)
+		}
+		maps.Copy(m, opts.Tags)
+		if err := validateTags(m); err != nil {
+			return err
+		}
+		for _, k := range slices.Sorted(maps.Keys(m)) {
+			tags = append(tags, types.Tag{Key: &k, Value: new(m[k])})
+		}
+	}
+
+	changeSetID := "cs-" + rand.Text()
+	inp := &cloudformation.CreateChangeSetInput{
+		StackName:     &stackName,
+		ChangeSetName: &changeSetID,
+		ChangeSetType: types.ChangeSetTypeUpdate,
+		Parameters:    params,
+		TemplateBody:  new(string(template)),
+		Description:   &opts.Description,
+		Capabilities:  stack.Capabilities,
+		Tags:          tags,
+	}
+
+	// Even though there's a logic below on CreateChangeSet that catches types.InsufficientCapabilitiesException,
+	// CloudFormation isn't very consistent returning it, and in some cases I've seen CreateChangeSet succeeding,
+	// and failing on the execution stage, reaching FAILED status and “Requires capabilities : [CAPABILITY_IAM]”
+	// status reason.
+	for _, c := range opts.Capabilities {
+		if !slices.Contains(inp.Capabilities, c) {
+			inp.Capabilities = append(inp.Capabilities, c)
+		}
+	}
+	if opts.AutoCapabilities && regexp.MustCompile(`Type"?\s*:\s*"?AWS::IAM::`).Match(template) {
+		for _, cap := range [...]types.Capability{types.CapabilityCapabilityIam, types.CapabilityCapabilityNamedIam} {
+			if !slices.Contains(inp.Capabilities, cap) {
+				inp.Capabilities = append(inp.Capabilities, cap)
+				logger.Println("added capability", cap)
+			}
+		}
+	}
+
+	if len(template) > 51_200 || opts.ForceUpload { // template is too big to be provided inline, or upload is forced
+		if opts.NoUpload {
+			return fmt.Errorf("template is %d bytes, which is over the 51200 bytes limit for inline templates, and upload to S3 is disabled; reduce template size, for example by removing comments and unused sections, or allow uploading it to S3", len(template))
+		}
+		if opts.S3 == nil {
+			return errors.New("template is too big to be provided inline, and no S3 client is configured to upload it")
+		}
+		region, err := arnRegion(*stack.StackId)
+		if err != nil {
+			return err
+		}
+		key := templateKey(opts.TemplateKeyPrefix, stackName, opts.TemplateKeyDate, template)
+		contentType := "application/yaml"
+		if format == "json" {
+			contentType = "application/json"
+		}
+		var newBucket bool
+		bucket, err := findTemplateBucket(ctx, opts.S3, region, opts.TemplateBucketTagKey, opts.TemplateBucketTagValue)
+		if errors.Is(err, errNoTemplateBucket) && opts.CreateBucket {
+			if bucket, err = createTemplateBucket(ctx, opts.S3, region); err == nil {
+				logger.Printf("created bucket %s to upload templates to", bucket)
+				newBucket = true
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("uploading template: %w", err)
+		}
+		url, err := uploadTemplate(ctx, opts.S3, region, bucket, key, contentType, opts.TemplateACL, template, newBucket)
+		if err != nil {
+			return fmt.Errorf("uploading template: %w", err)
+		}
+		inp.TemplateBody = nil
+		inp.TemplateURL = &url
+	}
+
+	// createChangeSet retries calls rejected because the stack is not
+	// ready for update yet, which may happen right after another operation
+	// completes.
+	createChangeSet := func() (*cloudformation.CreateChangeSetOutput, error) {
+		delay := 5 * time.Second
+		for i := 0; ; i++ {
+			out, err := svc.CreateChangeSet(ctx, inp)
+			if err == nil || !isStackNotReady(err) || i >= opts.CreateRetries {
+				return out, err
+			}
+			logger.Printf("stack is not ready for update, retrying in %v: %v", delay, err)
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(delay):
+			}
+			delay *= 2
+		}
+	}
+
+	ph.begin(PhaseCreateChangeSet)
+	createOut, err := createChangeSet()
+	if e, ok := errors.AsType[*types.InsufficientCapabilitiesException](err); ok {
+		missing := missingCapabilities(e.Error(), inp.Capabilities)
+		switch {
+		case len(missing) != 0 && opts.AutoCapabilities:
+			for _, c := range missing {
+				logger.Println("added missing capability", c)
+			}
+			inp.Capabilities = append(inp.Capabilities, missing...)
+			createOut, err = createChangeSet()
+		case len(missing) != 0:
+			return &InsufficientCapabilitiesError{Missing: missing, Err: err}
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("CreateChangeSet: %w", err)
+	}
+
+	var skipChangeSetDelete bool
+	defer func() {
+		if skipChangeSetDelete {
+			return
+		}
+		// don't use outer scope ctx because it may be already canceled
+		ctx, cancel := context.WithTimeout(context.Background(), opts.CleanupTimeout)
+		defer cancel()
+		begin := time.Now()
+		if _, err := svc.DeleteChangeSet(ctx, &cloudformation.DeleteChangeSetInput{
+			StackName:     &stackName,
+			ChangeSetName: &changeSetID,
+		}); err != nil {
+			logger.Printf("change set %q delete: %v", changeSetID, err)
+			return
+		}
+		if opts.Verbose {
+			logger.Printf("change set deleted in %v", time.Since(begin).Round(time.Millisecond))
+		}
+	}()
+
+	if createOut.Id == nil {
+		return errors.New("CreateChangeSet returned no change set id")
+	}
+	sum.ChangeSetID = *createOut.Id
+	ph.changeSetID = *createOut.Id
+	sum.setParameters(params, opts.Redact)
+
+	describeChangeSet := func(ctx context.Context) (*cloudformation.DescribeChangeSetOutput, error) {
+		return describeChangeSetRefreshing(ctx, opts, *createOut.Id)
+	}
+
+	logger.Print("waiting until change set is ready")
+	ph.begin(PhaseWaitChangeSet)
+
+	var descOut *cloudformation.DescribeChangeSetOutput
+
+	createCtx, cancel := contextWithTimeout(ctx, opts.CreateTimeout)
+	defer cancel()
+createWaitLoop:
+	for ticker := time.NewTicker(opts.PollInterval); ; {
+		select {
+		case <-createCtx.Done():
+			return fmt.Errorf("waiting for change set to be created: %w", createCtx.Err())
+		case <-ticker.C:
+		}
+		descOut, err = describeChangeSet(createCtx)
+		if err != nil {
+			return fmt.Errorf("DescribeChangeSet: %w", err)
+		}
+
+		switch descOut.Status {
+		case types.ChangeSetStatusCreatePending, types.ChangeSetStatusCreateInProgress: // continue polling
+		case types.ChangeSetStatusCreateComplete:
+			break createWaitLoop
+		case types.ChangeSetStatusFailed:
+			if descOut.StatusReason != nil && *descOut.StatusReason != "" {
+				if isNoChangesReason(*descOut.StatusReason) {
+					return ErrNoChanges
+				}
+				if missing := missingCapabilities(*descOut.StatusReason, inp.Capabilities); len(missing) != 0 {
+					return &InsufficientCapabilitiesError{Missing: missing, Err: errors.New(*descOut.StatusReason)}
+				}
+				if strings.Contains(*descOut.StatusReason, "DescribeEvents") {
+					if err := logChangeSetFailedEvents(ctx, logger, svc, *createOut.Id); err != nil {
+						logger.Printf("DescribeEvents: %v", err)
+					}
+				}
+				return fmt.Errorf("change set create: %v, %s", descOut.Status, *descOut.StatusReason)
+			}
+			return fmt.Errorf("change set create: %v", descOut.Status)
+		default:
+			return fmt.Errorf("unexpected change set status: %v", descOut.Status)
+		}
+	}
+
+	if s := descOut.ExecutionStatus; s != types.ExecutionStatusAvailable {
+		return fmt.Errorf("unexpected change set execution status: %v", s)
+	}
+	ph.end(nil)
+
+	if opts.OutputTemplate != "" {
+		stage := cmp.Or(opts.OutputTemplateStage, types.TemplateStageProcessed)
+		out, err := svc.GetTemplate(ctx, &cloudformation.GetTemplateInput{
+			StackName:     &stackName,
+			ChangeSetName: createOut.Id,
+			TemplateStage: stage,
+		})
+		if err != nil {
+			return fmt.Errorf("GetTemplate: %w", err)
+		}
+		if err := os.WriteFile(opts.OutputTemplate, []byte(unptr(out.TemplateBody)), 0666); err != nil {
+			return err
+		}
+		if opts.Verbose {
+			logger.Printf("%s template saved to %s", strings.ToLower(string(stage)), opts.OutputTemplate)
+		}
+	}
+
+	if opts.CSVOut != "" {
+		if err := writeChangesCSV(opts.CSVOut, descOut.Changes); err != nil {
+			return err
+		}
+	}
+
+	sum.setChanges(descOut.Changes)
+	if len(descOut.Changes) == 0 && (opts.NoExecuteIfEmpty || opts.DryRun) {
+		return ErrNoChanges
+	}
+
+	tpl, _ := parseTemplate(template) // without it, removed parameters are not shown
+	writeParameterChanges(opts.Stdout, stack.Parameters, params, tpl, opts.Redact)
+	changesOut := opts.Stdout
+	if opts.ChangesOut != nil {
+		changesOut = io.MultiWriter(opts.Stdout, opts.ChangesOut)
+	}
+	if err := writeChanges(changesOut, descOut.Changes, opts.GroupBy, opts.Format, opts.Filter); err != nil {
+		return err
+	}
+	if u := changeSetURL(*stack.StackId, *createOut.Id, opts.ConsoleDomain); u != "" {
+		fmt.Fprintf(opts.Stdout, "Change set details: %s\n\n", u)
+	}
+	if opts.FailOnIAMChanges {
+		if ids := iamChanges(descOut.Changes); len(ids) != 0 {
+			return fmt.Errorf("%w: %s", ErrIAMChanges, strings.Join(ids, ", "))
+		}
+	}
+	if opts.FailOnDestructive {
+		if ids := destructiveChanges(descOut.Changes); len(ids) != 0 {
+			return fmt.Errorf("%w: %s", ErrDestructiveChanges, strings.Join(ids, ", "))
+		}
+	}
+	if opts.DryRun {
+		return nil
+	}
+	if !opts.Yes {
+		fmt.Fprint(opts.Stdout, "Do you want to continue? [y/N] ")
+		type result struct {
+			input string
+			err   error
+		}
+		ch := make(chan result, 1)
+		go func() {
+			input, err := bufio.NewReader(io.LimitReader(opts.Stdin, 10)).ReadString('\n')
+			ch <- result{input, err}
+		}()
+		var timeout <-chan time.Time
+		if opts.PromptTimeout > 0 {
+			timer := time.NewTimer(opts.PromptTimeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		var input string
+		select {
+		case <-ctx.Done():
+			fmt.Fprintln(opts.Stdout)
+			return ctx.Err()
+		case <-timeout:
+			fmt.Fprintln(opts.Stdout)
+			return errors.New("aborted: no answer to confirmation prompt within " + opts.PromptTimeout.String())
+		case r := <-ch:
+			switch {
+			case errors.Is(r.err, io.EOF) && strings.TrimSpace(r.input) == "":
+				// input is closed without an answer, which is not a
+				// read failure
+				fmt.Fprintln(opts.Stdout)
+				if !opts.YesOnEOF {
+					return errors.New("aborted: input closed without an answer to confirmation prompt")
+				}
+				logger.Print("input closed without an answer to confirmation prompt, executing change set")
+				r.input = "y"
+			case errors.Is(r.err, io.EOF):
+				// last line without a trailing newline
+			case r.err != nil:
+				return fmt.Errorf("reading answer to confirmation prompt: %w", r.err)
+			}
+			input = r.input
+		}
+		switch strings.ToLower(strings.TrimSpace(input)) {
+		case "y", "yes":
+		default:
+			return errors.New("aborted")
+		}
+	}
+
+	if opts.ExecuteDelay > 0 {
+		if err := countdown(ctx, opts.Stdout, opts.ExecuteDelay); err != nil {
+			return err
+		}
+	}
+
+	if opts.BeforeExecute != nil {
+		if err := opts.BeforeExecute(ctx, *stack.StackId, *createOut.Id); err != nil {
+			return fmt.Errorf("before execute: %w", err)
+		}
+	}
+	if opts.AfterExecute != nil {
+		defer func() { opts.AfterExecute(context.WithoutCancel(ctx), *stack.StackId, *createOut.Id, err) }()
+	}
+
+	if len(opts.StackPolicy) != 0 {
+		if _, err := svc.SetStackPolicy(ctx, &cloudformation.SetStackPolicyInput{
+			StackName:       &stackName,
+			StackPolicyBody: new(string(opts.StackPolicy)),
+		}); err != nil {
+			return fmt.Errorf("SetStackPolicy: %w", err)
+		}
+	}
+
+	executeStart := time.Now()
+	eventsSince := executeStart
+	if !opts.EventsSince.IsZero() {
+		eventsSince = opts.EventsSince
+	}
+	ph.begin(PhaseExecuteChangeSet)
+	if _, err := svc.ExecuteChangeSet(ctx, &cloudformation.ExecuteChangeSetInput{ChangeSetName: createOut.Id}); err != nil {
+		return fmt.Errorf("ExecuteChangeSet: %w", err)
+	}
+	ph.begin(PhaseWaitUpdate)
+	executeCtx, cancel := contextWithTimeout(ctx, opts.ExecuteTimeout)
+	defer cancel()
+	var updateComplete bool
+	if opts.RollbackOnTimeout {
+		defer func() {
+			if updateComplete || !errors.Is(executeCtx.Err(), context.DeadlineExceeded) {
+				return
+			}
+			logger.Print("timed out waiting for update to complete, canceling update, which rolls the stack back")
+			// don't use outer scope ctx because it's already canceled
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if _, err := svc.CancelUpdateStack(ctx, &cloudformation.CancelUpdateStackInput{StackName: &stackName}); err != nil {
+				logger.Printf("CancelUpdateStack: %v", err)
+			}
+		}()
+	}
+	if opts.AuditOut != "" {
+		rec := newAuditRecord(opts.Caller, stack, *createOut.Id, params, descOut.Changes, opts.Redact)
+		if err := writeAuditRecord(ctx, opts.S3, opts.AuditOut, rec); err != nil {
+			logger.Printf("WARNING: failed to write audit record to %s: %v", opts.AuditOut, err)
+		}
+	}
+
+	logger.Print("waiting for update to complete, follow the stack update progress in the AWS console")
+	if opts.OpenConsole != nil {
+		if err := opts.OpenConsole(*stack.StackId); err != nil {
+			logger.Printf("opening browser: %v", err)
+		}
+	}
+
+	if err := waitExecution(executeCtx, opts, *stack.StackId, *createOut.Id, descOut.Changes, eventsSince, sum.failures); err != nil {
+		return err
+	}
+	skipChangeSetDelete = true
+	updateComplete = true
+	ph.end(nil)
+	elapsed := time.Since(executeStart).Round(time.Second)
+	if stack, err := DescribeStack(ctx, svc, stackName); err == nil {
+		logger.Printf("stack update finished in %v, stack status: %v", elapsed, stack.StackStatus)
+	} else {
+		logger.Printf("stack update finished in %v, but checking stack status failed: %v", elapsed, err)
+	}
+	if tp := opts.TerminationProtection; tp != nil && *tp != unptr(stack.EnableTerminationProtection) {
+		if _, err := svc.UpdateTerminationProtection(ctx, &cloudformation.UpdateTerminationProtectionInput{
+			StackName:                   stack.StackId,
+			EnableTerminationProtection: tp,
+		}); err != nil {
+			return fmt.Errorf("stack updated, but UpdateTerminationProtection failed: %w", err)
+		}
+		logger.Printf("turned stack termination protection %s", onOff(*tp))
+	}
+	return nil
+}
+
+// stackParameters returns parameters to create a change set with: current
+// stack parameters, with values from overrides, or previous values, or
+// omitted, as the strategy and declared template parameters require,
+// followed by overrides for parameters the stack doesn't have yet, in sorted
+// order. It also returns sorted names of the latter. It runs in linear time
+// of the number of parameters.
+func stackParameters(current []types.Parameter, overrides map[string]string, strategy string, declared map[string]templateParameter) (params []types.Parameter, added []string) {
+	params = make([]types.Parameter, 0, len(current)+len(overrides))
+	seen := make(map[string]bool, len(current))
+	for _, p := range current {
+		k := unptr(p.ParameterKey)
+		seen[k] = true
+		if v, ok := overrides[k]; ok {
+			params = append(params, types.Parameter{ParameterKey: &k, ParameterValue: &v})
+			continue
+		}
+		switch strategy {
+		case "replace":
+			continue
+		case "reset":
+			if declared[k].Default != nil {
+				continue
+			}
+		}
+		params = append(params, types.Parameter{ParameterKey: &k, UsePreviousValue: new(true)})
+	}
+	for _, k := range slices.Sorted(maps.Keys(overrides)) {
+		if !seen[k] {
+			added = append(added, k)
+			params = append(params, types.Parameter{ParameterKey: &k, ParameterValue: new(overrides[k])})
+		}
+	}
+	return params, added
+}
+
+// countdown writes the time left until delay passes to w every second,
+// returning an error if ctx is canceled before that.
+func countdown(ctx context.Context, w io.Writer, delay time.Duration) error {
+	deadline := time.Now().Add(delay)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		left := time.Until(deadline)
+		if left <= 0 {
+			fmt.Fprintln(w)
+			return nil
+		}
+		fmt.Fprintf(w, "\rexecuting change set in %v, interrupt to abort ", (left + time.Second - 1).Truncate(time.Second))
+		select {
+		case <-ctx.Done():
+			fmt.Fprintln(w)
+			return fmt.Errorf("aborted before executing change set: %w", ctx.Err())
+		case <-ticker.C:
+		case <-time.After(left):
+		}
+	}
+}
+
+// describeChangeSetRefreshing calls DescribeChangeSet, retrying calls
+// rejected because of expired credentials if credentials can be refreshed,
+// so that long waits don't fail over temporary credentials expiring.
+func describeChangeSetRefreshing(ctx context.Context, opts Options, changeSetID string) (*cloudformation.DescribeChangeSetOutput, error) {
+	for i := 0; ; i++ {
+		out, err := opts.CloudFormation.DescribeChangeSet(ctx, &cloudformation.DescribeChangeSetInput{ChangeSetName: &changeSetID})
+		if err == nil || !isExpiredCredentials(err) {
+			return out, err
+		}
+		if opts.RefreshCredentials == nil || i == 2 {
+			return nil, fmt.Errorf("credentials expired and could not be refreshed: %w", err)
+		}
+		opts.Logger.Print("credentials expired, refreshing")
+		opts.RefreshCredentials()
+	}
+}
+
+// waitExecution waits until execution of the change set completes,
+// reporting stack events newer than eventsSince and progress of changes as
+// configured by opts. If failures is not nil, it records resource failures
+// reported by stack events to it.
+func waitExecution(ctx context.Context, opts Options, stackID, changeSetID string, changes []types.Change, eventsSince time.Time, failures map[string]resourceFailure) error {
+	svc, logger := opts.CloudFormation, opts.Logger
+	var lastEventID string
+	// with Progress, logical ids of resources to change, and of those that
+	// reached a *_COMPLETE status
+	pending, done := make(map[string]bool), make(map[string]bool)
+	for _, c := range changes {
+		if rc := c.ResourceChange; rc != nil {
+			pending[unptr(rc.LogicalResourceId)] = true
+		}
+	}
+	var bufferedEvents []types.StackEvent // with EventsOnFailure, events to print if update fails
+	printEvents := func(evs []types.StackEvent) {
+		if opts.TailLines > 0 && len(evs) > opts.TailLines {
+			logger.Printf("skipped %d earlier events", len(evs)-opts.TailLines)
+			evs = evs[len(evs)-opts.TailLines:]
+		}
+		for _, e := range evs {
+			logger.Println(e.Timestamp.Format(time.TimeOnly), unptr(e.LogicalResourceId), unptr(e.ResourceType), e.ResourceStatus, unptr(e.ResourceStatusReason))
+		}
+	}
+
+	for ticker := time.NewTicker(opts.PollInterval); ; {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for update to complete: %w", ctx.Err())
+		case <-ticker.C:
+		}
+		descOut, err := describeChangeSetRefreshing(ctx, opts, changeSetID)
+		if err != nil {
+			if isExpiredCredentials(err) {
+				return fmt.Errorf("DescribeChangeSet: %w; stack update continues, follow its progress in the AWS console", err)
+			}
+			return fmt.Errorf("DescribeChangeSet: %w", err)
+		}
+		if opts.Events || opts.EventsOnFailure || opts.Progress || failures != nil {
+			evs, err := newStackEvents(ctx, svc, stackID, lastEventID, eventsSince)
+			if err != nil {
+				logger.Printf("DescribeStackEvents: %v", err)
+			}
+			if len(evs) != 0 {
+				lastEventID = unptr(evs[len(evs)-1].EventId)
+			}
+			if failures != nil {
+				recordFailures(failures, evs)
+			}
+			switch {
+			case opts.Events:
+				printEvents(evs)
+			case opts.EventsOnFailure:
+				bufferedEvents = append(bufferedEvents, evs...)
+			}
+			if opts.Progress && len(pending) != 0 {
+				n := len(done)
+				for _, e := range evs {
+					id := unptr(e.LogicalResourceId)
+					if s := string(e.ResourceStatus); pending[id] && strings.HasSuffix(s, "_COMPLETE") && !strings.Contains(s, "ROLLBACK") {
+						done[id] = true
+					}
+				}
+				if len(done) != n {
+					logger.Printf("progress: %d/%d resources updated (%d%%)", len(done), len(pending), 100*len(done)/len(pending))
+				}
+			}
+		}
+		switch descOut.ExecutionStatus {
+		case types.ExecutionStatusExecuteInProgress:
+		case types.ExecutionStatusExecuteComplete:
+			return nil
+		default:
+			printEvents(bufferedEvents)
+			return fmt.Errorf("change set execution status: %v", descOut.ExecutionStatus)
+		}
+	}
+}
+
+// writeChanges renders resource changes as a table followed by an empty
+// line, and a warning if any of the changes may replace or remove resources.
+// If groupBy is "type", changes are rendered as separate tables per resource
+// type. If format is "diff", changes are rendered one per line prefixed with
+// a diff-like marker instead of a table, see diffMarker. Changes not passing
+// the filter are not shown, but are counted, and considered for the warning.
+func writeChanges(w io.Writer, changes []types.Change, groupBy, format string, filter ChangeFilter) error {
+	var warn bool
+	for _, c := range changes {
+		if c.Type != types.ChangeTypeResource {
+			return fmt.Errorf("unsupported change type: %v", c.Type)
+		}
+		rc := c.ResourceChange
+		warn = warn || rc.Action == types.ChangeActionRemove || (rc.Replacement != "" && rc.Replacement != types.ReplacementFalse)
+	}
+	total := len(changes)
+	changes = filter.apply(changes)
+	switch {
+	case len(changes) == 0:
+	case groupBy == "type":
+		groups := make(map[string][]*types.ResourceChange)
+		for _, c := range changes {
+			t := unptr(c.ResourceChange.ResourceType)
+			groups[t] = append(groups[t], c.ResourceChange)
+		}
+		for _, t := range slices.Sorted(maps.Keys(groups)) {
+			rcs := groups[t]
+			noun := "changes"
+			if len(rcs) == 1 {
+				noun = "change"
+			}
+			fmt.Fprintf(w, "\n%d %s %s:\n", len(rcs), t, noun)
+			writeChangeRows(w, rcs, format, false)
+		}
+	default:
+		rcs := make([]*types.ResourceChange, len(changes))
+		for i, c := range changes {
+			rcs[i] = c.ResourceChange
+		}
+		fmt.Fprintln(w)
+		writeChangeRows(w, rcs, format, true)
+	}
+
+	fmt.Fprintln(w)
+	if n := total - len(changes); n != 0 {
+		fmt.Fprintf(w, "%d of %d changes are hidden by filters.\n", n, total)
+	}
+	if warn {
+		fmt.Fprintln(w, "\033[1mThis update may replace or remove some resources.\033[0m")
+	}
+	return nil
+}
+
+// writeChangeRows renders resource changes either as a table, or, if format
+// is "diff", as diff-like lines. If withType is false, resource types are
+// omitted.
+func writeChangeRows(w io.Writer, rcs []*types.ResourceChange, format string, withType bool) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	defer tw.Flush()
+	if format == "diff" {
+		for _, rc := range rcs {
+			marker := diffMarker(rc)
+			// every line starts with an escape sequence of the same
+			// length to keep columns aligned: bold for replacements,
+			// reset for others
+			style := "\033[0m"
+			if marker == "-/+" {
+				style = "\033[1m"
+			}
+			line := style + marker + "\t" + unptr(rc.LogicalResourceId) + "\t"
+			if withType {
+				line += unptr(rc.ResourceType) + "\t"
+			}
+			if rc.Replacement == types.ReplacementConditional {
+				line += "(may be replaced)\t"
+			}
+			fmt.Fprintln(tw, line+"\033[0m")
+		}
+		return
+	}
+	if withType {
+		fmt.Fprintln(tw, "Action\tReplacement\tResType\tLogicalID\tPhysicalID\t")
+	} else {
+		fmt.Fprintln(tw, "Action\tReplacement\tLogicalID\tPhysicalID\t")
+	}
+	for _, rc := range rcs {
+		if withType {
+			fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t\n", rc.Action, rc.Replacement, unptr(rc.ResourceType), unptr(rc.LogicalResourceId), unptr(rc.PhysicalResourceId))
+		} else {
+			fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t\n", rc.Action, rc.Replacement, unptr(rc.LogicalResourceId), unptr(rc.PhysicalResourceId))
+		}
+	}
+}
+
+// diffMarker returns a Terraform plan-like marker of the change: "+" for
+// additions, "~" for modifications, "-" for removals, and "-/+" for
+// replacements.
+func diffMarker(rc *types.ResourceChange) string {
+	switch rc.Action {
+	case types.ChangeActionAdd:
+		return "+"
+	case types.ChangeActionRemove:
+		return "-"
+	case types.ChangeActionModify:
+		if rc.Replacement == types.ReplacementTrue || rc.Replacement == types.ReplacementConditional {
+			return "-/+"
+		}
+		return "~"
+	}
+	return "?"
+}
+
+// DescribeStack returns the stack with the given name or id. Errors for
+// stacks that don't exist wrap ErrStackNotFound.
+func DescribeStack(ctx context.Context, svc cloudformation.DescribeStacksAPIClient, stackName string) (types.Stack, error) {
+	desc, err := svc.DescribeStacks(ctx, &cloudformation.DescribeStacksInput{StackName: &stackName})
+	if err != nil {
+		if e, ok := errors.AsType[smithy.APIError](err); ok && e.ErrorCode() == "ValidationError" && strings.Contains(e.ErrorMessage(), "does not exist") {
+			return types.Stack{}, fmt.Errorf("%w: %w", ErrStackNotFound, err)
+		}
+		return types.Stack{}, err
+	}
+	if l := len(desc.Stacks); l != 1 {
+		return types.Stack{}, fmt.Errorf("DescribeStacks returned %d stacks, expected 1", l)
+	}
+	return desc.Stacks[0], nil
+}
+
+// waitStackReady polls stack status until it's no longer in any of the
+// *_IN_PROGRESS states, or timeout expires.
+func waitStackReady(ctx context.Context, svc CloudFormationAPI, stackName string, interval, timeout time.Duration) (types.Stack, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	for ticker := time.NewTicker(interval); ; {
+		select {
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return types.Stack{}, fmt.Errorf("%w waiting for stack to finish its in-progress operation", ErrTimeout)
+			}
+			return types.Stack{}, ctx.Err()
+		case <-ticker.C:
+		}
+		stack, err := DescribeStack(ctx, svc, stackName)
+		if err != nil {
+			return types.Stack{}, err
+		}
+		if !strings.HasSuffix(string(stack.StackStatus), "_IN_PROGRESS") {
+			return stack, nil
+		}
+	}
+}
+
+// validateTags checks tags against CloudFormation limits, reporting all
+// violations at once.
+func validateTags(tags map[string]string) error {
+	var errs []error
+	if len(tags) > 50 {
+		errs = append(errs, fmt.Errorf("stack can have at most 50 tags, got %d", len(tags)))
+	}
+	for _, k := range slices.Sorted(maps.Keys(tags)) {
+		v := tags[k]
+		switch l := utf8.RuneCountInString(k); {
+		case l == 0:
+			errs = append(errs, errors.New("empty tag key"))
+		case l > 128:
+			errs = append(errs, fmt.Errorf("tag key %q is %d characters long, limit is 128", k, l))
+		}
+		if strings.HasPrefix(k, "aws:") {
+			errs = append(errs, fmt.Errorf("tag key %q uses reserved aws: prefix", k))
+		}
+		switch l := utf8.RuneCountInString(v); {
+		case l == 0:
+			errs = append(errs, fmt.Errorf("tag %q has an empty value", k))
+		case l > 256:
+			errs = append(errs, fmt.Errorf("tag %q value is %d characters long, limit is 256", k, l))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// missingCapabilities returns capabilities mentioned in text, such as
+// “Requires capabilities : [CAPABILITY_IAM]”, that are not in have.
+func missingCapabilities(text string, have []types.Capability) []types.Capability {
+	var out []types.Capability
+	for _, s := range regexp.MustCompile(`CAPABILITY_[A-Z_]+`).FindAllString(text, -1) {
+		c := types.Capability(s)
+		if slices.Contains(c.Values(), c) && !slices.Contains(have, c) && !slices.Contains(out, c) {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+func joinCapabilities(caps []types.Capability) string {
+	var ss []string
+	for _, c := range caps {
+		ss = append(ss, string(c))
+	}
+	return strings.Join(ss, ",")
+}
+
+// isExpiredCredentials reports whether err is caused by AWS rejecting
+// expired credentials.
+func isExpiredCredentials(err error) bool {
+	if e, ok := errors.AsType[smithy.APIError](err); ok {
+		switch e.ErrorCode() {
+		case "ExpiredToken", "ExpiredTokenException", "TokenRefreshRequired":
+			return true
+		}
+	}
+	return false
+}
+
+// resourcePolicyTypes are resource types outside of AWS::IAM:: that hold
+// resource-based policies.
+var resourcePolicyTypes = map[string]bool{
+	"AWS::S3::BucketPolicy":                  true,
+	"AWS::SQS::QueuePolicy":                  true,
+	"AWS::SNS::TopicPolicy":                  true,
+	"AWS::KMS::Key":                          true,
+	"AWS::Lambda::Permission":                true,
+	"AWS::Lambda::LayerVersionPermission":    true,
+	"AWS::SecretsManager::ResourcePolicy":    true,
+	"AWS::Events::EventBusPolicy":            true,
+	"AWS::Logs::ResourcePolicy":              true,
+	"AWS::ECR::RegistryPolicy":               true,
+	"AWS::S3Express::BucketPolicy":           true,
+	"AWS::S3ObjectLambda::AccessPointPolicy": true,
+}
+
+// policyProperties are names of resource properties holding IAM policy
+// documents, or attaching policies.
+var policyProperties = map[string]bool{
+	"PolicyDocument":            true,
+	"Policies":                  true,
+	"AssumeRolePolicyDocument":  true,
+	"KeyPolicy":                 true,
+	"ResourcePolicy":            true,
+	"RepositoryPolicyText":      true,
+	"AccessPolicies":            true,
+	"ManagedPolicyArns":         true,
+	"PermissionsBoundary":       true,
+	"FileSystemPolicy":          true,
+	"AccessPolicy":              true,
+	"PermissionsPolicyDocument": true,
+}
+
+// iamChanges returns logical ids of resources whose changes affect IAM,
+// see Options.FailOnIAMChanges.
+func iamChanges(changes []types.Change) []string {
+	var out []string
+	for _, c := range changes {
+		rc := c.ResourceChange
+		if rc == nil {
+			continue
+		}
+		typ := unptr(rc.ResourceType)
+		iam := strings.HasPrefix(typ, "AWS::IAM::") || strings.HasPrefix(typ, "AWS::SSO::") || resourcePolicyTypes[typ]
+		for _, d := range rc.Details {
+			if t := d.Target; t != nil && t.Attribute == types.ResourceAttributeProperties && policyProperties[unptr(t.Name)] {
+				iam = true
+			}
+		}
+		if iam {
+			out = append(out, fmt.Sprintf("%s (%s)", unptr(rc.LogicalResourceId), typ))
+		}
+	}
+	return out
+}
+
+// destructiveChanges returns logical ids of resources that changes remove
+// or replace, with what is done to them, see Options.FailOnDestructive.
+func destructiveChanges(changes []types.Change) []string {
+	var out []string
+	for _, c := range changes {
+		rc := c.ResourceChange
+		if rc == nil {
+			continue
+		}
+		var what string
+		switch {
+		case rc.Action == types.ChangeActionRemove:
+			what = "removed"
+		case rc.Replacement == types.ReplacementTrue:
+			what = "replaced"
+		case rc.Replacement == types.ReplacementConditional:
+			what = "may be replaced"
+		default:
+			continue
+		}
+		out = append(out, fmt.Sprintf("%s (%s) %s", unptr(rc.LogicalResourceId), unptr(rc.ResourceType), what))
+	}
+	return out
+}
+
+// managedStack returns a non-empty description if stack is managed by
+// another stack or a StackSet.
+func managedStack(stack types.Stack) string {
+	switch {
+	case stack.ParentId != nil:
+		return "is nested in stack " + *stack.ParentId
+	case strings.HasPrefix(unptr(stack.StackName), "StackSet-"):
+		return "looks like a StackSet instance"
+	}
+	for _, t := range stack.Tags {
+		if strings.HasPrefix(unptr(t.Key), "aws:cloudformation:stack-set-") {
+			return "is a StackSet instance"
+		}
+	}
+	return ""
+}
+
+// isStackNotReady reports whether err is a CloudFormation rejection of an
+// operation because the stack has another operation in progress.
+func isStackNotReady(err error) bool {
+	if e, ok := errors.AsType[smithy.APIError](err); ok && e.ErrorCode() == "ValidationError" {
+		return strings.Contains(e.ErrorMessage(), "_IN_PROGRESS state")
+	}
+	return false
+}
+
+// isNoChangesReason reports whether the change set status reason says that
+// the change set failed because there is nothing to update.
+func isNoChangesReason(reason string) bool {
+	return strings.Contains(reason, "didn't contain changes") ||
+		strings.Contains(reason, "No updates are to be performed")
+}
+
+// templateFormat guesses template format from its body: "json" if it's an
+// object, "yaml" otherwise.
+func templateFormat(body []byte) string {
+	if bytes.HasPrefix(bytes.TrimSpace(body), []byte("{")) {
+		return "json"
+	}
+	return "yaml"
+}
+
+func logChangeSetFailedEvents(ctx context.Context, logger *log.Logger, svc CloudFormationAPI, changeSetName string) error {
+	p := cloudformation.NewDescribeEventsPaginator(svc, &cloudformation.DescribeEventsInput{
+		ChangeSetName: &changeSetName,
+		Filters:       &types.EventFilter{FailedEvents: new(true)},
+	})
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, e := range page.OperationEvents {
+			logger.Println(unptr(e.LogicalResourceId), e.EventType, unptr(e.ValidationName), e.ValidationStatus, unptr(e.ValidationPath), unptr(e.ValidationStatusReason))
+		}
+	}
+	return nil
+}
+
+// newStackEvents returns stack events that happened after the event with
+// lastID, or after the since time if lastID is empty, in chronological order.
+func newStackEvents(ctx context.Context, svc CloudFormationAPI, stackID, lastID string, since time.Time) ([]types.StackEvent, error) {
+	var out []types.StackEvent
+	p := cloudformation.NewDescribeStackEventsPaginator(svc, &cloudformation.DescribeStackEventsInput{StackName: &stackID})
+paginate:
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range page.StackEvents {
+			if lastID != "" && unptr(e.EventId) == lastID {
+				break paginate
+			}
+			if e.Timestamp == nil || e.Timestamp.Before(since) {
+				break paginate
+			}
+			out = append(out, e)
+		}
+	}
+	slices.Reverse(out)
+	return out, nil
+}
+
+func arnRegion(arn string) (string, error) {
+	if !strings.HasPrefix(arn, "arn:") {
+		return "", fmt.Errorf("%q does not look like arn", arn)
+	}
+	var region string
+	var i int
+	for s := range strings.SplitSeq(arn, ":") {
+		if i == 3 {
+			region = s
+			break
+		}
+		i++
+	}
+	if region == "" {
+		return "", fmt.Errorf("cannot extract region from arn %q", arn)
+	}
+	return region, nil
+}
+
+// contextWithTimeout is like context.WithTimeout, but does not set a
+// deadline if timeout is not positive.
+func contextWithTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+func onOff(b bool) string {
+	if b {
+		return "on"
+	}
+	return "off"
+}
+
+func unptr[T any](v *T) T {
+	var zero T
+	if v != nil {
+		return *v
+	}
+	return zero
+}
@@ -0,0 +1,379 @@
+package stackupdate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation"
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation/types"
+)
+
+const testStackID = "arn:aws:cloudformation:us-east-1:123456789012:stack/test/11111111-2222-3333-4444-555555555555"
+
+// fakeCloudFormation simulates the change set lifecycle: CreateChangeSet
+// returns createOut, DescribeChangeSet returns created until the change set
+// is executed, and then ExecuteInProgress followed by executed.
+type fakeCloudFormation struct {
+	createOut  *cloudformation.CreateChangeSetOutput
+	createErr  error
+	created    cloudformation.DescribeChangeSetOutput
+	executeErr error
+	executed   types.ExecutionStatus
+
+	mu       sync.Mutex
+	calls    []string
+	executes int // DescribeChangeSet calls after ExecuteChangeSet
+}
+
+func newFakeCloudFormation(changes ...types.Change) *fakeCloudFormation {
+	return &fakeCloudFormation{
+		createOut: &cloudformation.CreateChangeSetOutput{Id: new("arn:aws:cloudformation:us-east-1:123456789012:changeSet/cs/1")},
+		created: cloudformation.DescribeChangeSetOutput{
+			Status:          types.ChangeSetStatusCreateComplete,
+			ExecutionStatus: types.ExecutionStatusAvailable,
+			Changes:         changes,
+		},
+		executed: types.ExecutionStatusExecuteComplete,
+	}
+}
+
+func (f *fakeCloudFormation) record(name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, name)
+}
+
+func (f *fakeCloudFormation) called(name string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var n int
+	for _, c := range f.calls {
+		if c == name {
+			n++
+		}
+	}
+	return n
+}
+
+func (f *fakeCloudFormation) DescribeStacks(context.Context, *cloudformation.DescribeStacksInput, ...func(*cloudformation.Options)) (*cloudformation.DescribeStacksOutput, error) {
+	f.record("DescribeStacks")
+	return &cloudformation.DescribeStacksOutput{Stacks: []types.Stack{{
+		StackName:   new("test"),
+		StackId:     new(testStackID),
+		StackStatus: types.StackStatusUpdateComplete,
+	}}}, nil
+}
+
+func (f *fakeCloudFormation) CreateChangeSet(context.Context, *cloudformation.CreateChangeSetInput, ...func(*cloudformation.Options)) (*cloudformation.CreateChangeSetOutput, error) {
+	f.record("CreateChangeSet")
+	return f.createOut, f.createErr
+}
+
+func (f *fakeCloudFormation) DeleteChangeSet(context.Context, *cloudformation.DeleteChangeSetInput, ...func(*cloudformation.Options)) (*cloudformation.DeleteChangeSetOutput, error) {
+	f.record("DeleteChangeSet")
+	return &cloudformation.DeleteChangeSetOutput{}, nil
+}
+
+func (f *fakeCloudFormation) DescribeChangeSet(context.Context, *cloudformation.DescribeChangeSetInput, ...func(*cloudformation.Options)) (*cloudformation.DescribeChangeSetOutput, error) {
+	f.record("DescribeChangeSet")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := f.created
+	if !f.isExecuted() {
+		return &out, nil
+	}
+	f.executes++
+	out.ExecutionStatus = types.ExecutionStatusExecuteInProgress
+	if f.executes > 1 {
+		out.ExecutionStatus = f.executed
+	}
+	return &out, nil
+}
+
+// isExecuted reports whether ExecuteChangeSet succeeded; f.mu must be held.
+func (f *fakeCloudFormation) isExecuted() bool {
+	for _, c := range f.calls {
+		if c == "ExecuteChangeSet" {
+			return f.executeErr == nil
+		}
+	}
+	return false
+}
+
+func (f *fakeCloudFormation) ExecuteChangeSet(context.Context, *cloudformation.ExecuteChangeSetInput, ...func(*cloudformation.Options)) (*cloudformation.ExecuteChangeSetOutput, error) {
+	f.record("ExecuteChangeSet")
+	if f.executeErr != nil {
+		return nil, f.executeErr
+	}
+	return &cloudformation.ExecuteChangeSetOutput{}, nil
+}
+
+func (f *fakeCloudFormation) DescribeEvents(context.Context, *cloudformation.DescribeEventsInput, ...func(*cloudformation.Options)) (*cloudformation.DescribeEventsOutput, error) {
+	f.record("DescribeEvents")
+	return &cloudformation.DescribeEventsOutput{}, nil
+}
+
+func (f *fakeCloudFormation) SetStackPolicy(context.Context, *cloudformation.SetStackPolicyInput, ...func(*cloudformation.Options)) (*cloudformation.SetStackPolicyOutput, error) {
+	f.record("SetStackPolicy")
+	return &cloudformation.SetStackPolicyOutput{}, nil
+}
+
+func (f *fakeCloudFormation) CancelUpdateStack(context.Context, *cloudformation.CancelUpdateStackInput, ...func(*cloudformation.Options)) (*cloudformation.CancelUpdateStackOutput, error) {
+	f.record("CancelUpdateStack")
+	return &cloudformation.CancelUpdateStackOutput{}, nil
+}
+
+func (f *fakeCloudFormation) DescribeStackEvents(context.Context, *cloudformation.DescribeStackEventsInput, ...func(*cloudformation.Options)) (*cloudformation.DescribeStackEventsOutput, error) {
+	f.record("DescribeStackEvents")
+	return &cloudformation.DescribeStackEventsOutput{}, nil
+}
+
+func (f *fakeCloudFormation) GetTemplate(context.Context, *cloudformation.GetTemplateInput, ...func(*cloudformation.Options)) (*cloudformation.GetTemplateOutput, error) {
+	f.record("GetTemplate")
+	return &cloudformation.GetTemplateOutput{}, nil
+}
+
+func (f *fakeCloudFormation) UpdateTerminationProtection(context.Context, *cloudformation.UpdateTerminationProtectionInput, ...func(*cloudformation.Options)) (*cloudformation.UpdateTerminationProtectionOutput, error) {
+	f.record("UpdateTerminationProtection")
+	return &cloudformation.UpdateTerminationProtectionOutput{}, nil
+}
+
+func testOptions(svc CloudFormationAPI) Options {
+	return Options{
+		StackName:      "test",
+		Template:       []byte("Resources:\n  Topic:\n    Type: AWS::SNS::Topic\n"),
+		CloudFormation: svc,
+		Yes:            true,
+		PollInterval:   time.Millisecond,
+		Stdout:         io.Discard,
+		Logger:         log.New(io.Discard, "", 0),
+	}
+}
+
+func testChange(id, typ string, action types.ChangeAction) types.Change {
+	return types.Change{
+		Type: types.ChangeTypeResource,
+		ResourceChange: &types.ResourceChange{
+			Action:            action,
+			LogicalResourceId: new(id),
+			ResourceType:      new(typ),
+		},
+	}
+}
+
+func TestRun(t *testing.T) {
+	svc := newFakeCloudFormation(testChange("Topic", "AWS::SNS::Topic", types.ChangeActionModify))
+	if err := Run(context.Background(), testOptions(svc)); err != nil {
+		t.Fatal(err)
+	}
+	if n := svc.called("ExecuteChangeSet"); n != 1 {
+		t.Errorf("ExecuteChangeSet called %d times, want 1", n)
+	}
+	if n := svc.called("DeleteChangeSet"); n != 0 {
+		t.Errorf("executed change set was deleted")
+	}
+}
+
+func TestRunChangeSetFailed(t *testing.T) {
+	svc := newFakeCloudFormation()
+	svc.created.Status = types.ChangeSetStatusFailed
+	svc.created.ExecutionStatus = types.ExecutionStatusUnavailable
+	svc.created.StatusReason = new("Template format error: Unresolved resource dependencies [Foo]")
+	err := Run(context.Background(), testOptions(svc))
+	if err == nil || !strings.Contains(err.Error(), "Unresolved resource dependencies") {
+		t.Fatalf("got error %v, want change set failure reason", err)
+	}
+	if errors.Is(err, ErrNoChanges) {
+		t.Fatalf("got ErrNoChanges for a failed change set")
+	}
+	if n := svc.called("ExecuteChangeSet"); n != 0 {
+		t.Errorf("failed change set was executed")
+	}
+	if n := svc.called("DeleteChangeSet"); n != 1 {
+		t.Errorf("DeleteChangeSet called %d times, want 1", n)
+	}
+}
+
+func TestRunNoChanges(t *testing.T) {
+	t.Run("failed without changes", func(t *testing.T) {
+		svc := newFakeCloudFormation()
+		svc.created.Status = types.ChangeSetStatusFailed
+		svc.created.ExecutionStatus = types.ExecutionStatusUnavailable
+		svc.created.StatusReason = new("The submitted information didn't contain changes. Submit different information to create a change set.")
+		if err := Run(context.Background(), testOptions(svc)); !errors.Is(err, ErrNoChanges) {
+			t.Fatalf("got error %v, want ErrNoChanges", err)
+		}
+		if n := svc.called("ExecuteChangeSet"); n != 0 {
+			t.Errorf("change set without changes was executed")
+		}
+	})
+	t.Run("empty change set", func(t *testing.T) {
+		svc := newFakeCloudFormation()
+		opts := testOptions(svc)
+		opts.NoExecuteIfEmpty = true
+		if err := Run(context.Background(), opts); !errors.Is(err, ErrNoChanges) {
+			t.Fatalf("got error %v, want ErrNoChanges", err)
+		}
+		if n := svc.called("ExecuteChangeSet"); n != 0 {
+			t.Errorf("empty change set was executed")
+		}
+		if n := svc.called("DeleteChangeSet"); n != 1 {
+			t.Errorf("DeleteChangeSet called %d times, want 1", n)
+		}
+	})
+}
+
+func TestRunExecuteFailed(t *testing.T) {
+	t.Run("ExecuteChangeSet error", func(t *testing.T) {
+		svc := newFakeCloudFormation(testChange("Topic", "AWS::SNS::Topic", types.ChangeActionModify))
+		svc.executeErr = errors.New("throttled")
+		err := Run(context.Background(), testOptions(svc))
+		if err == nil || !strings.Contains(err.Error(), "ExecuteChangeSet: throttled") {
+			t.Fatalf("got error %v, want ExecuteChangeSet failure", err)
+		}
+		if n := svc.called("DeleteChangeSet"); n != 1 {
+			t.Errorf("DeleteChangeSet called %d times, want 1", n)
+		}
+	})
+	t.Run("execution failed", func(t *testing.T) {
+		svc := newFakeCloudFormation(testChange("Topic", "AWS::SNS::Topic", types.ChangeActionModify))
+		svc.executed = types.ExecutionStatusExecuteFailed
+		err := Run(context.Background(), testOptions(svc))
+		if err == nil || !strings.Contains(err.Error(), string(types.ExecutionStatusExecuteFailed)) {
+			t.Fatalf("got error %v, want execution failure", err)
+		}
+	})
+}
+
+func TestRunNilChangeSetID(t *testing.T) {
+	svc := newFakeCloudFormation(testChange("Topic", "AWS::SNS::Topic", types.ChangeActionModify))
+	svc.createOut = &cloudformation.CreateChangeSetOutput{}
+	err := Run(context.Background(), testOptions(svc))
+	if err == nil || !strings.Contains(err.Error(), "no change set id") {
+		t.Fatalf("got error %v, want missing change set id error", err)
+	}
+	if n := svc.called("ExecuteChangeSet"); n != 0 {
+		t.Errorf("ExecuteChangeSet called %d times, want 0", n)
+	}
+}
+
+func TestRunTerminationProtection(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		modify func(*fakeCloudFormation, *Options)
+		want   int // UpdateTerminationProtection calls
+	}{
+		{"updated", func(*fakeCloudFormation, *Options) {}, 1},
+		{"dry run", func(_ *fakeCloudFormation, o *Options) { o.DryRun = true }, 0},
+		{"aborted", func(_ *fakeCloudFormation, o *Options) { o.Yes = false; o.Stdin = strings.NewReader("n\n") }, 0},
+		{"update failed", func(f *fakeCloudFormation, _ *Options) { f.executed = types.ExecutionStatusExecuteFailed }, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			svc := newFakeCloudFormation(testChange("Topic", "AWS::SNS::Topic", types.ChangeActionModify))
+			opts := testOptions(svc)
+			opts.TerminationProtection = new(true)
+			tc.modify(svc, &opts)
+			Run(context.Background(), opts)
+			if n := svc.called("UpdateTerminationProtection"); n != tc.want {
+				t.Errorf("UpdateTerminationProtection called %d times, want %d", n, tc.want)
+			}
+		})
+	}
+}
+
+func TestRunPromptParameters(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		interactive bool
+		wantErr     bool
+	}{
+		{"interactive", true, false},
+		{"not interactive", false, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			svc := newFakeCloudFormation(testChange("Topic", "AWS::SNS::Topic", types.ChangeActionModify))
+			opts := testOptions(svc)
+			opts.Template = []byte("Parameters:\n  Name:\n    Type: String\n" + string(opts.Template))
+			opts.PromptParameters = true
+			opts.Interactive = tc.interactive
+			opts.Yes = false
+			opts.Stdin = strings.NewReader("topic\ny\n")
+			err := Run(context.Background(), opts)
+			if tc.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "template parameters have no values: Name") {
+					t.Fatalf("got error %v, want missing parameters error", err)
+				}
+				if n := svc.called("CreateChangeSet"); n != 0 {
+					t.Errorf("CreateChangeSet called %d times, want 0", n)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestIAMChanges(t *testing.T) {
+	withProperty := func(c types.Change, name string) types.Change {
+		c.ResourceChange.Details = []types.ResourceChangeDetail{{Target: &types.ResourceTargetDefinition{
+			Attribute: types.ResourceAttributeProperties,
+			Name:      new(name),
+		}}}
+		return c
+	}
+	for _, tc := range []struct {
+		change types.Change
+		iam    bool
+	}{
+		{testChange("Role", "AWS::IAM::Role", types.ChangeActionModify), true},
+		{testChange("BucketPolicy", "AWS::S3::BucketPolicy", types.ChangeActionAdd), true},
+		{withProperty(testChange("Function", "AWS::Lambda::Function", types.ChangeActionModify), "PolicyDocument"), true},
+		{withProperty(testChange("Key", "AWS::KMS::Key", types.ChangeActionModify), "KeyPolicy"), true},
+		{testChange("Scaling", "AWS::AutoScaling::ScalingPolicy", types.ChangeActionModify), false},
+		{testChange("Scaling", "AWS::ApplicationAutoScaling::ScalingPolicy", types.ChangeActionModify), false},
+		{withProperty(testChange("Repository", "AWS::ECR::Repository", types.ChangeActionModify), "LifecyclePolicy"), false},
+		{withProperty(testChange("Bucket", "AWS::S3::Bucket", types.ChangeActionModify), "LifecycleConfiguration"), false},
+	} {
+		rc := tc.change.ResourceChange
+		if got := len(iamChanges([]types.Change{tc.change})) != 0; got != tc.iam {
+			t.Errorf("%s (%s) with %d details: got IAM change %v, want %v", unptr(rc.LogicalResourceId), unptr(rc.ResourceType), len(rc.Details), got, tc.iam)
+		}
+	}
+}
+
+// BenchmarkStackParameters builds change set parameters and renders their
+// changes for a stack with many parameters, half of them overridden, and
+// some overrides new to the stack.
+func BenchmarkStackParameters(b *testing.B) {
+	const n = 500
+	var current []types.Parameter
+	overrides := make(map[string]string)
+	declared := make(map[string]templateParameter)
+	for i := range n {
+		k := fmt.Sprintf("Param%03d", i)
+		current = append(current, types.Parameter{ParameterKey: new(k), ParameterValue: new("old")})
+		declared[k] = templateParameter{Type: "String", Default: new("default")}
+		if i%2 == 0 {
+			overrides[k] = "new"
+		}
+	}
+	for i := range n / 10 {
+		k := fmt.Sprintf("Added%03d", i)
+		overrides[k] = "value"
+		declared[k] = templateParameter{Type: "String"}
+	}
+	tpl := &parsedTemplate{Parameters: declared}
+	for b.Loop() {
+		params, _ := stackParameters(current, overrides, "reset", declared)
+		writeParameterChanges(io.Discard, current, params, tpl, nil)
+	}
+}
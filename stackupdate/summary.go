@@ -0,0 +1,107 @@
+package stackupdate
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation/types"
+)
+
+// runSummary describes a Run call, whatever its outcome.
+type runSummary struct {
+	StackName    string           `json:"stackName"`
+	StackID      string           `json:"stackId,omitempty"`
+	Region       string           `json:"region,omitempty"`
+	Account      string           `json:"account,omitempty"`
+	ChangeSetID  string           `json:"changeSetId,omitempty"`
+	Status       string           `json:"status"` // updated, dry-run, no-changes, or failed
+	Error        string           `json:"error,omitempty"`
+	ErrorKind    string           `json:"errorKind,omitempty"`
+	Counts       map[string]int   `json:"counts,omitempty"` // number of changes per action
+	Replacements []string         `json:"replacements,omitempty"`
+	Parameters   []auditParameter `json:"parameters,omitempty"`
+	Duration     float64          `json:"durationSeconds"`
+
+	changes  []types.Change             // kept for the history entry and JUnit report
+	failures map[string]resourceFailure // by logical resource id
+}
+
+func (s *runSummary) setStack(stack types.Stack) {
+	s.StackID = unptr(stack.StackId)
+	// arn:partition:cloudformation:region:account:stack/name/id
+	if f := strings.Split(s.StackID, ":"); len(f) > 4 {
+		s.Region, s.Account = f[3], f[4]
+	}
+}
+
+func (s *runSummary) setParameters(params []types.Parameter, redactRe *regexp.Regexp) {
+	s.Parameters = s.Parameters[:0]
+	for _, p := range params {
+		s.Parameters = append(s.Parameters, auditParameter{
+			Key:              unptr(p.ParameterKey),
+			Value:            redact(redactRe, unptr(p.ParameterKey), unptr(p.ParameterValue)),
+			UsePreviousValue: unptr(p.UsePreviousValue),
+		})
+	}
+}
+
+func (s *runSummary) setChanges(changes []types.Change) {
+	s.Counts = make(map[string]int)
+	s.changes = changes
+	for _, c := range changes {
+		rc := c.ResourceChange
+		if rc == nil {
+			continue
+		}
+		s.Counts[string(rc.Action)]++
+		if rc.Replacement != "" && rc.Replacement != types.ReplacementFalse {
+			s.Replacements = append(s.Replacements, unptr(rc.LogicalResourceId))
+		}
+	}
+}
+
+// finish sets summary status and error details from the result of Run.
+func (s *runSummary) finish(err error, dryRun bool, elapsed time.Duration) {
+	s.Duration = elapsed.Round(time.Millisecond).Seconds()
+	switch {
+	case err == nil && dryRun:
+		s.Status = "dry-run"
+	case err == nil:
+		s.Status = "updated"
+	case errors.Is(err, ErrNoChanges):
+		s.Status = "no-changes"
+	default:
+		s.Status = "failed"
+		s.Error = err.Error()
+		switch {
+		case errors.Is(err, ErrStackNotFound):
+			s.ErrorKind = "stack-not-found"
+		case errors.Is(err, ErrAccessDenied):
+			s.ErrorKind = "access-denied"
+		case errors.Is(err, ErrTimeout):
+			s.ErrorKind = "timeout"
+		case errors.Is(err, ErrManagedStack):
+			s.ErrorKind = "managed-stack"
+		case errors.Is(err, ErrIAMChanges):
+			s.ErrorKind = "iam-changes"
+		case errors.Is(err, ErrDestructiveChanges):
+			s.ErrorKind = "destructive-changes"
+		default:
+			if _, ok := errors.AsType[*InsufficientCapabilitiesError](err); ok {
+				s.ErrorKind = "insufficient-capabilities"
+			}
+		}
+	}
+}
+
+func writeSummary(name string, s *runSummary) error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name, append(b, '\n'), 0666)
+}
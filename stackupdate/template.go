@@ -0,0 +1,162 @@
+package stackupdate
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"go.yaml.in/yaml/v3"
+)
+
+// parsedTemplate holds the parts of a CloudFormation template inspected by
+// this package. It's parsed from both JSON and YAML templates, as JSON is a
+// subset of YAML; short form intrinsic functions like !Ref are tolerated.
+type parsedTemplate struct {
+	Parameters map[string]templateParameter `yaml:"Parameters"`
+	Resources  map[string]templateResource  `yaml:"Resources"`
+}
+
+type templateResource struct {
+	Type string `yaml:"Type"`
+}
+
+type templateParameter struct {
+	Type          string   `yaml:"Type"`
+	Description   string   `yaml:"Description"`
+	Default       *string  `yaml:"Default"`
+	NoEcho        string   `yaml:"NoEcho"`
+	AllowedValues []string `yaml:"AllowedValues"`
+
+	// constraints are kept as strings, as templates may use both quoted
+	// and unquoted numbers
+	AllowedPattern string `yaml:"AllowedPattern"`
+	MinLength      string `yaml:"MinLength"`
+	MaxLength      string `yaml:"MaxLength"`
+	MinValue       string `yaml:"MinValue"`
+	MaxValue       string `yaml:"MaxValue"`
+}
+
+func (p templateParameter) noEcho() bool { return strings.EqualFold(p.NoEcho, "true") }
+
+func parseTemplate(body []byte) (*parsedTemplate, error) {
+	var t parsedTemplate
+	if err := yaml.Unmarshal(body, &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// ec2IDPrefixes maps AWS-specific parameter types to the prefix their
+// values must have.
+var ec2IDPrefixes = map[string]string{
+	"AWS::EC2::Image::Id":         "ami-",
+	"AWS::EC2::Instance::Id":      "i-",
+	"AWS::EC2::SecurityGroup::Id": "sg-",
+	"AWS::EC2::Subnet::Id":        "subnet-",
+	"AWS::EC2::VPC::Id":           "vpc-",
+	"AWS::EC2::Volume::Id":        "vol-",
+}
+
+// undeclared returns sorted names of params not declared in the template.
+func (t *parsedTemplate) undeclared(params map[string]string) []string {
+	var out []string
+	for _, k := range slices.Sorted(maps.Keys(params)) {
+		if _, ok := t.Parameters[k]; !ok {
+			out = append(out, k)
+		}
+	}
+	return out
+}
+
+// validateParameters checks parameter values against types and constraints
+// declared in template, reporting all mismatches at once. Parameters not
+// declared in the template are not checked. Values of parameters with names
+// matching redactRe, or declared as NoEcho, are not included in errors.
+func (t *parsedTemplate) validateParameters(params map[string]string, redactRe *regexp.Regexp) error {
+	var errs []error
+	for _, k := range slices.Sorted(maps.Keys(params)) {
+		p, ok := t.Parameters[k]
+		if !ok {
+			continue
+		}
+		v := params[k]
+		if err := p.validate(v); err != nil {
+			if v != "" && (p.noEcho() || redact(redactRe, k, v) != v) {
+				err = errors.New(strings.ReplaceAll(err.Error(), v, redactedValue))
+			}
+			errs = append(errs, fmt.Errorf("parameter %s: %w", k, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (p templateParameter) validate(value string) error {
+	typ := p.Type
+	if strings.HasPrefix(typ, "AWS::SSM::Parameter::") {
+		return nil // value is a name of SSM parameter
+	}
+	if elemType, ok := strings.CutPrefix(typ, "List<"); ok || typ == "CommaDelimitedList" {
+		elemType = strings.TrimSuffix(elemType, ">")
+		for v := range strings.SplitSeq(value, ",") {
+			if v == "" {
+				return fmt.Errorf("%s value %q has an empty element", typ, value)
+			}
+			if strings.TrimSpace(v) != v {
+				return fmt.Errorf("%s value %q has an element with leading or trailing spaces", typ, value)
+			}
+			if err := validateScalar(elemType, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := validateScalar(typ, value); err != nil {
+		return err
+	}
+	if len(p.AllowedValues) != 0 && !slices.Contains(p.AllowedValues, value) {
+		return fmt.Errorf("value %q is not one of allowed values: %s", value, strings.Join(p.AllowedValues, ", "))
+	}
+	if p.AllowedPattern != "" {
+		if re, err := regexp.Compile("^(?:" + p.AllowedPattern + ")$"); err == nil && !re.MatchString(value) {
+			return fmt.Errorf("value %q does not match allowed pattern %s", value, p.AllowedPattern)
+		}
+	}
+	if typ == "String" {
+		l := utf8.RuneCountInString(value)
+		if n, err := strconv.Atoi(p.MinLength); err == nil && l < n {
+			return fmt.Errorf("value %q is shorter than %d characters", value, n)
+		}
+		if n, err := strconv.Atoi(p.MaxLength); err == nil && l > n {
+			return fmt.Errorf("value %q is longer than %d characters", value, n)
+		}
+	}
+	if typ == "Number" {
+		v, _ := strconv.ParseFloat(value, 64)
+		if n, err := strconv.ParseFloat(p.MinValue, 64); err == nil && v < n {
+			return fmt.Errorf("value %s is less than %s", value, p.MinValue)
+		}
+		if n, err := strconv.ParseFloat(p.MaxValue, 64); err == nil && v > n {
+			return fmt.Errorf("value %s is greater than %s", value, p.MaxValue)
+		}
+	}
+	return nil
+}
+
+// validateScalar checks a single value of a non-list parameter type.
+func validateScalar(typ, value string) error {
+	if typ == "Number" {
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			return fmt.Errorf("value %q is not a number", value)
+		}
+		return nil
+	}
+	if prefix, ok := ec2IDPrefixes[typ]; ok && !strings.HasPrefix(value, prefix) {
+		return fmt.Errorf("%s value %q does not start with %q", typ, value, prefix)
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package stackupdate
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// templateKey returns S3 object key to upload template body to:
+// prefix/stackName/hash, or prefix/stackName/YYYY-MM-DD/hash if withDate is
+// set.
+func templateKey(prefix, stackName string, withDate bool, body []byte) string {
+	hash := fmt.Sprintf("%x", sha256.Sum256(body))
+	if withDate {
+		return path.Join(prefix, stackName, time.Now().UTC().Format(time.DateOnly), hash)
+	}
+	return path.Join(prefix, stackName, hash)
+}
+
+// findTemplateBucket discovers a bucket in region to upload templates to.
+// If tagKey is set, it picks the first bucket having this tag with tagValue;
+// otherwise it picks the cf-templates-*-region bucket that CloudFormation
+// console creates.
+func findTemplateBucket(ctx context.Context, svc S3API, region, tagKey, tagValue string) (string, error) {
+	inp := &s3.ListBucketsInput{BucketRegion: &region}
+	if tagKey == "" {
+		inp.Prefix = new("cf-templates-")
+	}
+	p := s3.NewListBucketsPaginator(svc, inp)
+	suffix := "-" + region
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return "", err
+		}
+		for _, b := range page.Buckets {
+			if tagKey == "" {
+				if strings.HasSuffix(*b.Name, suffix) {
+					return *b.Name, nil
+				}
+				continue
+			}
+			out, err := svc.GetBucketTagging(ctx, &s3.GetBucketTaggingInput{Bucket: b.Name})
+			if err != nil {
+				continue // no tags, or no access to them
+			}
+			for _, t := range out.TagSet {
+				if unptr(t.Key) == tagKey && unptr(t.Value) == tagValue {
+					return *b.Name, nil
+				}
+			}
+		}
+	}
+	if tagKey != "" {
+		return "", fmt.Errorf("cannot discover bucket tagged %s=%s to upload template to", tagKey, tagValue)
+	}
+	return "", errNoTemplateBucket
+}
+
+var errNoTemplateBucket = errors.New("cannot discover bucket to upload template to")
+
+// createTemplateBucket creates a cf-templates-*-region bucket, like the one
+// CloudFormation console creates, and returns its name.
+func createTemplateBucket(ctx context.Context, svc S3API, region string) (string, error) {
+	name := "cf-templates-" + strings.ToLower(rand.Text()[:12]) + "-" + region
+	inp := &s3.CreateBucketInput{Bucket: &name}
+	if region != "us-east-1" {
+		inp.CreateBucketConfiguration = &types.CreateBucketConfiguration{
+			LocationConstraint: types.BucketLocationConstraint(region),
+		}
+	}
+	if _, err := svc.CreateBucket(ctx, inp); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// uploadTemplate uploads template body to the bucket and returns its url.
+// If the bucket has default SSE-KMS encryption, it explicitly requests the
+// same encryption on upload, to satisfy bucket policies that require it.
+// If acl is set, it's applied to the uploaded object as a canned ACL.
+// If newBucket is set, uploads failing because the bucket is not available
+// yet are retried.
+func uploadTemplate(ctx context.Context, svc S3API, region, bucket, key, contentType, acl string, body []byte, newBucket bool) (string, error) {
+	inp := &s3.PutObjectInput{
+		Bucket:      &bucket,
+		Key:         &key,
+		ContentType: &contentType,
+		ACL:         types.ObjectCannedACL(acl),
+	}
+	// errors are ignored: bucket may have no default encryption, or
+	// caller may have no permission to read it
+	if out, err := svc.GetBucketEncryption(ctx, &s3.GetBucketEncryptionInput{Bucket: &bucket}); err == nil && out.ServerSideEncryptionConfiguration != nil {
+		for _, r := range out.ServerSideEncryptionConfiguration.Rules {
+			d := r.ApplyServerSideEncryptionByDefault
+			if d == nil {
+				continue
+			}
+			switch d.SSEAlgorithm {
+			case types.ServerSideEncryptionAwsKms, types.ServerSideEncryptionAwsKmsDsse:
+				inp.ServerSideEncryption = d.SSEAlgorithm
+				inp.SSEKMSKeyId = d.KMSMasterKeyID
+				inp.BucketKeyEnabled = r.BucketKeyEnabled
+			}
+		}
+	}
+	if err := putObject(ctx, svc, inp, body, newBucket); err != nil {
+		return "", err
+	}
+	return templateURL(ctx, svc, region, bucket, key)
+}
+
+// templateURL returns path-style url of the uploaded template, resolved the
+// way svc resolves its endpoints, so that custom endpoints (e.g. of
+// LocalStack) and other partitions get matching urls.
+func templateURL(ctx context.Context, svc S3API, region, bucket, key string) (string, error) {
+	params := s3.EndpointParameters{
+		Region:         &region,
+		Bucket:         &bucket,
+		ForcePathStyle: new(true),
+	}
+	var resolver s3.EndpointResolverV2 = s3.NewDefaultEndpointResolverV2()
+	if c, ok := svc.(interface{ Options() s3.Options }); ok {
+		o := c.Options()
+		params.Endpoint = o.BaseEndpoint
+		if o.EndpointResolverV2 != nil {
+			resolver = o.EndpointResolverV2
+		}
+	}
+	ep, err := resolver.ResolveEndpoint(ctx, params)
+	if err != nil {
+		return "", fmt.Errorf("resolving S3 endpoint: %w", err)
+	}
+	u := ep.URI
+	u.Path = path.Join("/", u.Path, key)
+	return u.String(), nil
+}
+
+// putObject calls PutObject to upload body. If retry is set, it retries
+// calls failing with NoSuchBucket error for up to about 15 seconds, backing
+// off from 1 to 8 seconds, as a freshly created bucket may take a while to
+// become available.
+func putObject(ctx context.Context, svc S3API, inp *s3.PutObjectInput, body []byte, retry bool) error {
+	delay := time.Second
+	for i := 0; ; i++ {
+		inp.Body = bytes.NewReader(body)
+		_, err := svc.PutObject(ctx, inp)
+		if _, ok := errors.AsType[*types.NoSuchBucket](err); !ok || !retry {
+			return err
+		}
+		if i == 4 {
+			return fmt.Errorf("bucket %s is still not available after creation: %w", unptr(inp.Bucket), err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
@@ -0,0 +1,31 @@
+package stackupdate
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+func TestTemplateURL(t *testing.T) {
+	for _, tc := range []struct {
+		region   string
+		endpoint string
+		want     string
+	}{
+		{"us-east-1", "", "https://s3.us-east-1.amazonaws.com/bucket/prefix/key"},
+		{"cn-north-1", "", "https://s3.cn-north-1.amazonaws.com.cn/bucket/prefix/key"},
+		{"us-east-1", "http://localhost:4566", "http://localhost:4566/bucket/prefix/key"},
+	} {
+		o := s3.Options{Region: tc.region}
+		if tc.endpoint != "" {
+			o.BaseEndpoint = new(tc.endpoint)
+		}
+		got, err := templateURL(t.Context(), s3.New(o), tc.region, "bucket", "prefix/key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("region %s, endpoint %q: got %s, want %s", tc.region, tc.endpoint, got, tc.want)
+		}
+	}
+}
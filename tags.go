@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"go.yaml.in/yaml/v3"
+)
+
+// tagsFile loads stack tags from a JSON or YAML file holding either a
+// {"Key": "Value", ...} object, or a [{"Key": "Key", "Value": "Value"}, ...]
+// list.
+func tagsFile(name string) (map[string]string, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]string
+	if err := yaml.Unmarshal(b, &m); err == nil {
+		return m, nil
+	}
+	var list []struct {
+		Key   string `yaml:"Key"`
+		Value string `yaml:"Value"`
+	}
+	if err := yaml.Unmarshal(b, &list); err != nil {
+		return nil, fmt.Errorf(`%s: unsupported tags format, want either {"Key": "Value", ...}, or [{"Key": "Key", "Value": "Value"}, ...]`, name)
+	}
+	m = make(map[string]string, len(list))
+	for _, t := range list {
+		m[t.Key] = t.Value
+	}
+	return m, nil
+}
+
+// tagFlag collects repeated key=value flags into a map.
+type tagFlag map[string]string
+
+func (f tagFlag) String() string { return "" }
+
+func (f tagFlag) Set(s string) error {
+	k, v, ok := strings.Cut(s, "=")
+	if !ok || k == "" || v == "" {
+		return errors.New("want non-empty key=value")
+	}
+	f[k] = v
+	return nil
+}
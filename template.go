@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.yaml.in/yaml/v3"
+)
+
+// maxTemplateSize is the largest template size CloudFormation accepts.
+const maxTemplateSize = 1 << 20
+
+// readTemplate reads template from a local file, or downloads it if name is
+// an http(s) url. If gitRef is set, it reads the local file at this git ref
+// instead of the working tree.
+//
+// For downloaded templates, it also returns their Last-Modified time, if the
+// server reports it.
+func readTemplate(ctx context.Context, name, gitRef string) ([]byte, time.Time, error) {
+	if gitRef != "" {
+		if isURL(name) {
+			return nil, time.Time{}, errors.New("-git-ref requires a local template file, not an url")
+		}
+		b, err := gitShow(ctx, gitRef, name)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		if len(b) > maxTemplateSize {
+			return nil, time.Time{}, errors.New("template is too big")
+		}
+		return b, time.Time{}, nil
+	}
+	if !isURL(name) {
+		b, err := os.ReadFile(name)
+		return b, time.Time{}, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, name, nil)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, time.Time{}, fmt.Errorf("downloading template: unexpected response status %q", resp.Status)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxTemplateSize+1))
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("downloading template: %w", err)
+	}
+	if len(b) > maxTemplateSize {
+		return nil, time.Time{}, errors.New("template is too big")
+	}
+	lastModified, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return b, lastModified, nil
+}
+
+// isURL reports whether template name is an http(s) url.
+func isURL(name string) bool {
+	return strings.HasPrefix(name, "https://") || strings.HasPrefix(name, "http://")
+}
+
+// templateBase returns the last element of template file path, or url path.
+func templateBase(name string) string {
+	if isURL(name) {
+		if u, err := url.Parse(name); err == nil {
+			return path.Base(u.Path)
+		}
+	}
+	return filepath.Base(name)
+}
+
+// substitution is a literal find and replace applied to template body.
+type substitution struct{ old, new string }
+
+// substitutionsFlag collects repeated OLD=NEW flags, keeping their order.
+type substitutionsFlag []substitution
+
+func (f *substitutionsFlag) String() string { return "" }
+
+func (f *substitutionsFlag) Set(s string) error {
+	old, new, ok := strings.Cut(s, "=")
+	if !ok || old == "" {
+		return errors.New("want OLD=NEW with non-empty OLD")
+	}
+	*f = append(*f, substitution{old: old, new: new})
+	return nil
+}
+
+// substitute applies substitutions to body in order, each one to the result
+// of the previous ones.
+func substitute(body []byte, subs []substitution, verbose bool) []byte {
+	for _, s := range subs {
+		n := bytes.Count(body, []byte(s.old))
+		if verbose {
+			log.Printf("substitution %q: %d replacements", s.old, n)
+		}
+		if n != 0 {
+			body = bytes.ReplaceAll(body, []byte(s.old), []byte(s.new))
+		}
+	}
+	return body
+}
+
+// templateRegion returns the region set in Metadata.StackUpdate.Region of
+// the template, or an empty string if there's none.
+func templateRegion(body []byte) (string, error) {
+	var tpl struct {
+		Metadata struct {
+			StackUpdate struct {
+				Region string `yaml:"Region"`
+			} `yaml:"StackUpdate"`
+		} `yaml:"Metadata"`
+	}
+	if err := yaml.Unmarshal(body, &tpl); err != nil {
+		return "", fmt.Errorf("parsing template metadata: %w", err)
+	}
+	return tpl.Metadata.StackUpdate.Region, nil
+}
+
+// templateParameters returns the set of parameter names declared in the
+// template.
+func templateParameters(body []byte) (map[string]bool, error) {
+	var tpl struct {
+		Parameters map[string]any `yaml:"Parameters"`
+	}
+	if err := yaml.Unmarshal(body, &tpl); err != nil {
+		return nil, fmt.Errorf("parsing template parameters: %w", err)
+	}
+	m := make(map[string]bool, len(tpl.Parameters))
+	for k := range tpl.Parameters {
+		m[k] = true
+	}
+	return m, nil
+}
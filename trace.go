@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/artyom/stack-update/stackupdate"
+)
+
+// tracer collects spans of the run and exports them as a single OpenTelemetry
+// trace with OTLP over HTTP, using JSON encoding. A nil *tracer is valid and
+// does nothing, which is what newTracer returns unless OTLP endpoint is
+// configured.
+type tracer struct {
+	endpoint string
+	headers  map[string]string
+	service  string
+	traceID  string
+	rootID   string
+	start    time.Time
+
+	mu    sync.Mutex
+	spans []otlpSpan
+}
+
+// newTracer returns a tracer configured with standard OTEL_* environment
+// variables: OTEL_EXPORTER_OTLP_TRACES_ENDPOINT or OTEL_EXPORTER_OTLP_ENDPOINT,
+// OTEL_EXPORTER_OTLP_HEADERS, and OTEL_SERVICE_NAME. It returns nil if no
+// endpoint is set.
+func newTracer() (*tracer, error) {
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" {
+		base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+		if base == "" {
+			return nil, nil
+		}
+		endpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+	}
+	if _, err := url.Parse(endpoint); err != nil {
+		return nil, fmt.Errorf("OTLP endpoint: %w", err)
+	}
+	t := &tracer{
+		endpoint: endpoint,
+		headers:  make(map[string]string),
+		service:  "stack-update",
+		traceID:  randomHex(16),
+		rootID:   randomHex(8),
+		start:    time.Now(),
+	}
+	if s := os.Getenv("OTEL_SERVICE_NAME"); s != "" {
+		t.service = s
+	}
+	if s := os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"); s != "" {
+		for kv := range strings.SplitSeq(s, ",") {
+			k, v, ok := strings.Cut(kv, "=")
+			if !ok {
+				return nil, fmt.Errorf("OTEL_EXPORTER_OTLP_HEADERS: want key=value pairs, got %q", kv)
+			}
+			if uv, err := url.QueryUnescape(v); err == nil {
+				v = uv
+			}
+			t.headers[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
+	return t, nil
+}
+
+// span records a span that is a child of the root span of the trace.
+// Attributes are given as key, value pairs; empty values are skipped.
+// ErrNoChanges is not treated as an error.
+func (t *tracer) span(name string, start time.Time, err error, attrs ...string) {
+	if t == nil {
+		return
+	}
+	s := newOTLPSpan(t.traceID, randomHex(8), name, start, time.Now(), err, attrs)
+	s.ParentSpanID = t.rootID
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.spans = append(t.spans, s)
+}
+
+// phaseHook returns a function suitable for stackupdate.Options.OnPhase,
+// recording phases as spans tagged with stack name and region.
+func (t *tracer) phaseHook(stackName, region string) func(string, time.Time, string, error) {
+	if t == nil {
+		return nil
+	}
+	return func(name string, start time.Time, changeSetID string, err error) {
+		t.span(name, start, err,
+			"cloudformation.stack.name", stackName,
+			"cloud.region", region,
+			"cloudformation.change_set.id", changeSetID)
+	}
+}
+
+// finish records the root span, which ends with err, and exports all spans.
+func (t *tracer) finish(err error) error {
+	if t == nil {
+		return nil
+	}
+	root := newOTLPSpan(t.traceID, t.rootID, "stack-update", t.start, time.Now(), err, nil)
+	root.Kind = 1 // internal
+	t.mu.Lock()
+	spans := append(t.spans, root)
+	t.mu.Unlock()
+	var rs otlpResourceSpans
+	rs.Resource.Attributes = otlpAttributes([]string{"service.name", t.service})
+	rs.ScopeSpans = []otlpScopeSpans{{Spans: spans}}
+	rs.ScopeSpans[0].Scope.Name = "github.com/artyom/stack-update"
+	req := otlpRequest{ResourceSpans: []otlpResourceSpans{rs}}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	for k, v := range t.headers {
+		r.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("exporting trace to %s: %s", t.endpoint, resp.Status)
+	}
+	return nil
+}
+
+// otlpRequest is the JSON encoding of OTLP ExportTraceServiceRequest.
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpSpan struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId,omitempty"`
+	Name         string          `json:"name"`
+	Kind         int             `json:"kind"`
+	Start        string          `json:"startTimeUnixNano"`
+	End          string          `json:"endTimeUnixNano"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+	Status       struct {
+		Code    int    `json:"code,omitempty"` // 1 is ok, 2 is error
+		Message string `json:"message,omitempty"`
+	} `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+func newOTLPSpan(traceID, spanID, name string, start, end time.Time, err error, attrs []string) otlpSpan {
+	s := otlpSpan{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		Name:       name,
+		Kind:       3, // client
+		Start:      strconv.FormatInt(start.UnixNano(), 10),
+		End:        strconv.FormatInt(end.UnixNano(), 10),
+		Attributes: otlpAttributes(attrs),
+	}
+	if err != nil && !errors.Is(err, stackupdate.ErrNoChanges) {
+		s.Status.Code = 2
+		s.Status.Message = err.Error()
+	}
+	return s
+}
+
+// otlpAttributes converts key, value pairs to attributes, skipping empty
+// values.
+func otlpAttributes(kv []string) []otlpAttribute {
+	var out []otlpAttribute
+	for i := 0; i+1 < len(kv); i += 2 {
+		if kv[i+1] == "" {
+			continue
+		}
+		var a otlpAttribute
+		a.Key, a.Value.StringValue = kv[i], kv[i+1]
+		out = append(out, a)
+	}
+	return out
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
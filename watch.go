@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/artyom/stack-update/stackupdate"
+)
+
+// watch shows changes the template would make, like -dry-run does, then
+// shows them again each time the template file is modified, until ctx is
+// canceled.
+func watch(ctx context.Context, opts stackupdate.Options, args cliArgs) error {
+	if args.templateFile == "" || isURL(args.templateFile) {
+		return errors.New("-watch requires a local template file as the first argument")
+	}
+	if args.batch != "" {
+		return errors.New("-watch is mutually exclusive with -batch")
+	}
+	if args.gitRef != "" {
+		return errors.New("-watch is mutually exclusive with -git-ref")
+	}
+	opts.DryRun = true
+	fi, err := os.Stat(args.templateFile)
+	if err != nil {
+		return err
+	}
+	for {
+		if err := run(ctx, opts, args); err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			logger(opts).Print(err)
+		}
+		logger(opts).Printf("watching %s for changes, press Ctrl+C to stop", args.templateFile)
+		if fi, err = waitModified(ctx, args.templateFile, fi); err != nil {
+			break
+		}
+	}
+	if errors.Is(ctx.Err(), context.Canceled) {
+		return nil // interrupted
+	}
+	return ctx.Err()
+}
+
+// waitModified polls file name until its modification time or size differ
+// from those of prev, and returns its new info.
+func waitModified(ctx context.Context, name string, prev os.FileInfo) (os.FileInfo, error) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+		fi, err := os.Stat(name)
+		if err != nil {
+			continue // editors may replace file by renaming a new one over it
+		}
+		if !fi.ModTime().Equal(prev.ModTime()) || fi.Size() != prev.Size() {
+			return fi, nil
+		}
+	}
+}